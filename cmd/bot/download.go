@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// runDownload downloads a single object, decrypting it if needed
+func runDownload(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	key := fs.String("key", "", "object name to download (required)")
+	out := fs.String("out", "", "output file, - for stdout (default the object's file name)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" {
+		return fmt.Errorf("-key is required")
+	}
+	if *out == "" {
+		*out = path.Base(*key)
+	}
+
+	cfg := config.LoadConfig()
+	backend, err := store.OpenBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
+
+	reader, err := backend.DownloadFile(ctx, *key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if *out == "-" {
+		_, err = io.Copy(os.Stdout, reader)
+		return err
+	}
+
+	file, err := os.Create(*out)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(*out)
+		return fmt.Errorf("failed to download %s: %w", *key, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloaded %s to %s\n", *key, *out)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/export"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/handler"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/processor"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// runExport writes a peer's archive in the Telegram Desktop export format
+func runExport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := fs.String("user", "", "peer ID, username or phone of the archived peer (required)")
+	prefix := fs.String("prefix", "", "object prefix of the archive (default derived from OBJECT_KEY_TEMPLATE)")
+	out := fs.String("out", "", "output directory (default export_{peer_id})")
+	upload := fs.Bool("zip", false, "upload the export as a zip to exports/{peer_id}/ instead of keeping the directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+
+	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	idx, err := index.Open(filepath.Join(store.DefaultSessionDir, indexFile))
+	if err != nil {
+		return err
+	}
+	alias, err := findPeer(idx, *user)
+	if err != nil {
+		return err
+	}
+
+	name := alias.Name()
+	if name == "" {
+		name = strings.TrimPrefix(*user, "@")
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("export_%d", alias.ID)
+	}
+
+	backend, err := store.OpenBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
+
+	// Zipped exports are built in a temporary directory
+	outDir := *out
+	if *upload {
+		outDir, err = os.MkdirTemp("", "teleminio-export-")
+		if err != nil {
+			return fmt.Errorf("create temp directory: %w", err)
+		}
+		defer os.RemoveAll(outDir)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return fmt.Errorf("create output directory: %w", err)
+	}
+
+	// Without a prefix the export covers every layout the peer's objects are stored in
+	exporter := export.NewExporter(backend)
+	prefixes := []string{*prefix}
+	if *prefix == "" {
+		prefixes = exportPrefixes(cfg, alias)
+		exporter.PeerID = alias.ID
+		exporter.Exclude = []string{handler.TrashPrefix + "/", processor.PreviewPrefix + "/", "exports/"}
+	}
+
+	chat, err := exporter.Export(ctx, prefixes, name, outDir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d messages from %s\n", len(chat.Messages), strings.Join(prefixes, ", "))
+
+	if !*upload {
+		fmt.Println("Export written to", outDir)
+		return nil
+	}
+
+	// Build the zip next to the export and upload it
+	file, err := os.CreateTemp("", "teleminio-export-*.zip")
+	if err != nil {
+		return fmt.Errorf("create zip: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := export.ZipDir(outDir, file); err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("seek zip: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek zip: %w", err)
+	}
+
+	objectName := fmt.Sprintf("exports/%d/%s.zip", alias.ID, time.Now().UTC().Format("20060102T150405Z"))
+	url, err := backend.UploadFile(ctx, objectName, file, size, store.UploadOptions{ContentType: "application/zip"})
+	if err != nil {
+		return err
+	}
+	if cfg.Encryption != "" && cfg.Encryption != config.EncryptionNone {
+		fmt.Printf("Export uploaded as %s, fetch it with: teleminio-uploader download -key %s\n", objectName, objectName)
+		return nil
+	}
+	fmt.Println("Export uploaded to", url)
+	return nil
+}
+
+// exportPrefixes returns the key prefixes that hold the message archive and
+// media of a peer under the configured key template and quota route prefix
+func exportPrefixes(cfg config.Config, alias index.Alias) []string {
+	template := handler.KeyTemplate(cfg)
+	usernames := []string{""}
+	if strings.Contains(template, "{username}") {
+		for _, u := range alias.Usernames {
+			usernames = append(usernames, u.Value)
+		}
+	}
+
+	prefixes := []string{fmt.Sprintf("%d/messages/", alias.ID)}
+	for _, username := range usernames {
+		p := handler.KeyPrefix(template, handler.KeyFields{PeerID: alias.ID, Username: username})
+		prefixes = append(prefixes, p)
+		if cfg.Quota.RoutePrefix != "" {
+			prefixes = append(prefixes, strings.TrimPrefix(path.Join(cfg.Quota.RoutePrefix, p)+"/", "/"))
+		}
+	}
+
+	// Drop prefixes already covered by a shorter one
+	sort.Strings(prefixes)
+	var result []string
+	for _, p := range prefixes {
+		if len(result) > 0 && strings.HasPrefix(p, result[len(result)-1]) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/export"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/handler"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// runImport uploads the media of a Telegram Desktop export directory
+func runImport(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	user := fs.String("user", "", "username of the exported peer (default from the alias index)")
+	dir := fs.String("dir", "", "export directory containing result.json (required)")
+	self := fs.Int64("self", 0, "user ID of the exporting account, marks its messages as sent")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	chat, err := export.ReadExport(*dir)
+	if err != nil {
+		return err
+	}
+
+	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	backend, err := store.OpenBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
+
+	idx, err := index.Open(filepath.Join(store.DefaultSessionDir, indexFile))
+	if err != nil {
+		return fmt.Errorf("failed to initialize index: %w", err)
+	}
+
+	// Objects are keyed by the peer ID from the export
+	username := strings.TrimPrefix(*user, "@")
+	if username == "" {
+		if alias, found, err := idx.GetAlias(chat.ID); err == nil && found {
+			username = alias.Username()
+		}
+	}
+
+	// Uploads go through the same path as live messages
+	h := handler.NewMessageHandler(nil, backend, nil, idx, nil, cfg)
+	registerProcessors(h, backend, cfg)
+	trackQuota(h, idx, cfg)
+
+	var failed int
+	for _, m := range chat.Media {
+		path, cleanup, err := importPath(m.Path, cfg.StripExif)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = h.ArchiveFile(ctx, handler.MediaFile{
+			Path:      path,
+			Kind:      m.Kind,
+			Attrs:     m.Attrs,
+			MessageID: m.MessageID,
+			Date:      m.Date,
+			PeerID:    chat.ID,
+			Channel:   chat.Channel,
+			Username:  username,
+			Out:       *self != 0 && m.FromID == fmt.Sprintf("user%d", *self),
+		})
+		cleanup()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			fmt.Printf("Error importing %s: %v\n", m.Path, err)
+		}
+	}
+
+	fmt.Printf("Imported %d of %d files from %s\n", len(chat.Media)-failed, len(chat.Media), *dir)
+	return nil
+}
+
+// importPath returns the path to upload a file from. Files are copied to a
+// temporary location when EXIF stripping would otherwise modify the export.
+func importPath(path string, stripExif bool) (string, func(), error) {
+	if !stripExif {
+		return path, func() {}, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("open file: %w", err)
+	}
+	defer src.Close()
+
+	// Keep the original name as it is used in the object name
+	tmpDir, err := os.MkdirTemp("", "teleminio-import-")
+	if err != nil {
+		return "", nil, fmt.Errorf("create temp directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	dst, err := os.Create(filepath.Join(tmpDir, filepath.Base(path)))
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("create temp file: %w", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("copy file: %w", err)
+	}
+	return dst.Name(), cleanup, nil
+}
@@ -6,22 +6,37 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/gotd/contrib/storage"
 	"github.com/gotd/td/examples"
 	"github.com/gotd/td/telegram/auth"
 	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/query"
 	"github.com/gotd/td/telegram/updates"
 	"github.com/pkg/errors"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/cache"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/client"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/handler"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/processor"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/quota"
 	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/utils"
 )
 
+// indexFile is the name of the local index database in the session directory
+const indexFile = "index.bolt.db"
+
 func run(ctx context.Context) error {
 	// Load configuration
 	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
 
 	// Initialize storage
 	s, err := store.NewStorage(cfg.Phone)
@@ -29,17 +44,70 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("failed to initialize storage: %w", err)
 	}
 
-	// Initialize Minio
-	minio, err := store.NewMinio(cfg)
+	// Initialize storage backend
+	backend, err := store.OpenBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
+
+	// Keep uploads on local disk while storage is unavailable
+	spooled, err := store.NewSpooled(backend, filepath.Join(s.SessionDir, "spool"), cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize upload spool: %w", err)
+	}
+	if err := spooled.Probe(ctx); store.IsUnavailable(err) {
+		fmt.Println("Storage is unavailable, spooling uploads until it recovers:", err)
+		spooled.Breaker.Trip()
+	}
+	backend = spooled
+
+	// Bring the bucket in line with the declared lifecycle and retention
+	// policy, or once storage is back if it is down
+	if minioClient, ok := store.Find[*store.MinioClient](backend); ok {
+		applyPolicy := func(ctx context.Context) error {
+			return minioClient.ApplyPolicy(ctx, cfg.BucketPolicy)
+		}
+		if !spooled.Breaker.Allow() {
+			spooled.Recovered = applyPolicy
+		} else if err := applyPolicy(ctx); err != nil {
+			fmt.Println("Error applying bucket policy:", err)
+		}
+	}
+	go spooled.Run(ctx)
+
+	// Catch up storage targets that missed writes
+	if replicated, ok := store.Find[*store.Replicated](backend); ok {
+		go replicated.Run(ctx)
+	}
+
+	// The local backend serves its links itself
+	if local, ok := store.Find[*store.LocalStorage](backend); ok {
+		go func() {
+			if err := local.Serve(ctx); err != nil {
+				fmt.Println("Error serving local storage:", err)
+			}
+		}()
+	}
+
+	// Initialize local index
+	idx, err := index.Open(filepath.Join(s.SessionDir, indexFile))
 	if err != nil {
-		return fmt.Errorf("failed to initialize MinIO: %w", err)
+		return fmt.Errorf("failed to initialize index: %w", err)
+	}
+
+	// Large uploads record their progress in the index so they survive restarts
+	if minioClient, ok := store.Find[*store.MinioClient](backend); ok {
+		minioClient.Uploads = idx
+		go minioClient.RunCleanup(ctx, cfg.UploadCleanupInterval, cfg.UploadStaleAfter)
 	}
 
 	// Initialize logger
 	logger := config.LoadLogger(s.SessionDir)
 
 	// Initialize Telegram client
-	clientSetup, err := client.NewClient(cfg.AppID, cfg.AppHash, s, logger)
+	// Peers seen in updates also maintain the alias index
+	peers := store.NewAliasPeerStorage(s.PeerDB, idx)
+	clientSetup, err := client.NewClient(cfg.AppID, cfg.AppHash, s, peers, logger)
 	if err != nil {
 		return fmt.Errorf("failed to initialize Telegram client: %w", err)
 	}
@@ -47,23 +115,95 @@ func run(ctx context.Context) error {
 	// Initialize media downloader
 	mediaDir := filepath.Join(s.SessionDir, "media")
 	downloader := utils.NewMediaDownloader(clientSetup.API, mediaDir)
+	downloader.Verify = cfg.VerifyDownloads
 
 	// Initialize sender
 	sender := message.NewSender(clientSetup.API)
 
 	// Initialize message handler
-	messageHandler := handler.NewMessageHandler(downloader, minio, s.PeerDB, sender, cfg)
+	messageHandler := handler.NewMessageHandler(downloader, backend, peers, idx, sender, cfg)
+
+	// Message archives and the audit trail are flushed periodically
+	messageHandler.Archive = archive.NewChatArchive(backend, filepath.Join(s.SessionDir, "archive"), cfg.ArchiveFlushInterval)
+	go messageHandler.Archive.Run(ctx)
+	defer func() {
+		// Upload what is left before exiting
+		if err := messageHandler.Archive.Flush(context.Background()); err != nil {
+			fmt.Println("Error flushing message archive:", err)
+		}
+	}()
+
+	// Register post-processing steps
+	registerProcessors(messageHandler, backend, cfg)
+
+	// Track storage usage per peer for quotas
+	trackQuota(messageHandler, idx, cfg)
+
+	// Keep uploaded media around within the cache limits
+	if cfg.MediaCacheSize > 0 {
+		mediaCache := cache.New(mediaDir, cfg.MediaCacheSize, cfg.MediaCacheMaxAge, cfg.MediaMinFreeDisk)
+		if err := mediaCache.Load(); err != nil {
+			fmt.Println("Error loading media cache:", err)
+		}
+		downloader.Cache = mediaCache
+		messageHandler.Cache = mediaCache
+		go mediaCache.Run(ctx, time.Minute)
+	}
+
+	// Archive media left over from earlier runs; files written from now on
+	// belong to this run
+	reconcileOpts := handler.ReconcileOptions{
+		Keep:   !cfg.AUTO_REMOVE_MEDIA || messageHandler.Cache != nil,
+		Before: time.Now(),
+	}
+	reconcile := func() {
+		report, err := messageHandler.Reconcile(ctx, mediaDir, reconcileOpts)
+		if err != nil {
+			fmt.Println("Error reconciling media directory:", err)
+		}
+		printReconcileReport(report)
+	}
+	switch {
+	case !cfg.ReconcileMedia:
+	case messageHandler.Cache != nil:
+		// A media cache can hold a lot of files, so it is reconciled in the background
+		go reconcile()
+	default:
+		reconcile()
+	}
 
-	// Handle new messages
+	// Handle new and edited messages
 	clientSetup.Dispatcher.OnNewMessage(messageHandler.HandleNewMessage)
+	clientSetup.Dispatcher.OnEditMessage(messageHandler.HandleEditMessage)
+	clientSetup.Dispatcher.OnEditChannelMessage(messageHandler.HandleEditChannelMessage)
+
+	// Mirror deletions
+	clientSetup.Dispatcher.OnDeleteMessages(messageHandler.HandleDeleteMessages)
+	clientSetup.Dispatcher.OnDeleteChannelMessages(messageHandler.HandleDeleteChannelMessages)
 
 	// Run the client
 	return clientSetup.Waiter.Run(ctx, func(ctx context.Context) error {
-		return start(ctx, cfg, clientSetup)
+		return start(ctx, cfg, clientSetup, messageHandler, peers)
 	})
 }
 
-func start(ctx context.Context, cfg config.Config, clientSetup *client.Setup) error {
+// trackQuota loads the storage usage of every peer so that uploads count
+// towards their quota
+func trackQuota(h *handler.MessageHandler, idx *index.Index, cfg config.Config) {
+	h.Quota = quota.NewTracker()
+	if err := h.Quota.Load(idx, cfg.DeleteMode != handler.DeleteModeDelete); err != nil {
+		fmt.Println("Error loading storage usage:", err)
+	}
+}
+
+// registerProcessors adds the configured post-processing steps to a handler
+func registerProcessors(h *handler.MessageHandler, backend store.Storage, cfg config.Config) {
+	if len(cfg.PreviewSizes) > 0 {
+		h.Processors = append(h.Processors, processor.NewPreviewProcessor(backend, cfg.PreviewSizes))
+	}
+}
+
+func start(ctx context.Context, cfg config.Config, clientSetup *client.Setup, messageHandler *handler.MessageHandler, peers storage.PeerStorage) error {
 	flow := auth.NewFlow(examples.Terminal{PhoneNumber: cfg.Phone}, auth.SendCodeOptions{})
 	err := clientSetup.Client.Run(ctx, func(ctx context.Context) error {
 		// Authenticate if necessary
@@ -84,13 +224,23 @@ func start(ctx context.Context, cfg config.Config, clientSetup *client.Setup) er
 		}
 		fmt.Println("Current user:", name)
 
-		// // Fill peer storage
-		// fmt.Println("Filling peer storage from dialogs to cache entities")
-		// collector := storage.CollectPeers(s.PeerDB)
-		// if err := collector.Dialogs(ctx, query.GetDialogs(clientSetup.API).Iter()); err != nil {
-		// 	return errors.Wrap(err, "collect peers")
-		// }
-		// fmt.Println("Filled")
+		// Commands are taken from the account's Saved Messages
+		messageHandler.SelfID = self.ID
+
+		// Fill peer storage
+		if cfg.WarmupDialogs {
+			fmt.Println("Filling peer storage from dialogs to cache entities")
+			collector := storage.CollectPeers(peers)
+			if err := collector.Dialogs(ctx, query.GetDialogs(clientSetup.API).Iter()); err != nil {
+				return errors.Wrap(err, "collect peers")
+			}
+			fmt.Println("Filled")
+		}
+
+		// Resolve targets so typos are reported instead of failing silently
+		if err := messageHandler.ResolveTargets(ctx, clientSetup.Resolver); err != nil {
+			return errors.Wrap(err, "resolve targets")
+		}
 
 		// Start listening for updates
 		fmt.Println("Listening for updates. Interrupt (Ctrl+C) to stop.")
@@ -112,7 +262,31 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	if err := run(ctx); err != nil {
+	// Pick the subcommand, running the bot by default
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "run":
+		err = run(ctx)
+	case "query":
+		err = runQuery(args)
+	case "export":
+		err = runExport(ctx, args)
+	case "import":
+		err = runImport(ctx, args)
+	case "download":
+		err = runDownload(ctx, args)
+	case "reconcile":
+		err = runReconcile(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if err != nil {
 		if errors.Is(err, context.Canceled) && ctx.Err() == context.Canceled {
 			fmt.Println("Application stopped")
 			os.Exit(0)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// runQuery lists archived media from the local index
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	user := fs.String("user", "", "only media from this peer ID, username or phone")
+	mediaType := fs.String("type", "", "only this media type (photo, video, round, audio, voice, document)")
+	direction := fs.String("direction", "", "only sent or received media")
+	minDuration := fs.Duration("min-duration", 0, "minimum duration, e.g. 10m")
+	maxDuration := fs.Duration("max-duration", 0, "maximum duration")
+	since := fs.String("since", "", "only media sent on or after this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "only media sent before this date (YYYY-MM-DD)")
+	deleted := fs.Bool("deleted", false, "include media of messages deleted in Telegram")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := index.Filter{
+		Type:        *mediaType,
+		Direction:   *direction,
+		MinDuration: *minDuration,
+		MaxDuration: *maxDuration,
+
+		IncludeDeleted: *deleted,
+	}
+	var err error
+	if filter.Since, err = parseDate(*since); err != nil {
+		return fmt.Errorf("invalid -since: %w", err)
+	}
+	if filter.Until, err = parseDate(*until); err != nil {
+		return fmt.Errorf("invalid -until: %w", err)
+	}
+
+	idx, err := index.Open(filepath.Join(store.DefaultSessionDir, indexFile))
+	if err != nil {
+		return err
+	}
+
+	// Match peers by ID so renamed users are found under any of their names
+	if *user != "" {
+		alias, err := findPeer(idx, *user)
+		if err != nil {
+			filter.Username = strings.TrimPrefix(*user, "@")
+		}
+		filter.PeerID = alias.ID
+	}
+
+	entries, err := idx.Query(filter)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tTYPE\tDURATION\tRESOLUTION\tSIZE\tKEY")
+	for _, e := range entries {
+		duration, resolution := "-", "-"
+		if e.Duration > 0 {
+			duration = (time.Duration(e.Duration) * time.Second).String()
+		}
+		if e.Width > 0 && e.Height > 0 {
+			resolution = fmt.Sprintf("%dx%d", e.Width, e.Height)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", e.Date.Format(time.DateTime), e.Type, duration, resolution, e.Size, e.Key)
+	}
+	return w.Flush()
+}
+
+// findPeer looks up a peer in the alias index by ID, current or past username, or phone
+func findPeer(idx *index.Index, query string) (index.Alias, error) {
+	alias, found, err := idx.FindAlias(query)
+	if err != nil {
+		return alias, err
+	}
+	if found {
+		return alias, nil
+	}
+
+	// Unknown numeric IDs are still usable as object prefixes
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		return index.Alias{ID: id}, nil
+	}
+	return alias, fmt.Errorf("peer %q not found in the alias index", query)
+}
+
+// parseDate parses an optional YYYY-MM-DD date in local time
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/handler"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// runReconcile archives media files left in the media directory by earlier runs
+func runReconcile(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dir := fs.String("dir", filepath.Join(store.DefaultSessionDir, "media"), "media directory to reconcile")
+	dryRun := fs.Bool("dry-run", false, "only report what would be done")
+	keep := fs.Bool("keep", false, "keep archived files in the media directory")
+	minAge := fs.Duration("min-age", time.Hour, "skip files modified more recently, which a running bot may still be using")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	backend, err := store.OpenBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage backend: %w", err)
+	}
+
+	idx, err := index.Open(filepath.Join(store.DefaultSessionDir, indexFile))
+	if err != nil {
+		return fmt.Errorf("failed to initialize index: %w", err)
+	}
+
+	// Uploads go through the same path as live messages
+	h := handler.NewMessageHandler(nil, backend, nil, idx, nil, cfg)
+	registerProcessors(h, backend, cfg)
+	trackQuota(h, idx, cfg)
+
+	report, err := h.Reconcile(ctx, *dir, handler.ReconcileOptions{
+		DryRun: *dryRun,
+		Keep:   *keep,
+		Before: time.Now().Add(-*minAge),
+	})
+	printReconcileReport(report)
+	return err
+}
+
+// printReconcileReport summarizes a reconciliation
+func printReconcileReport(report handler.ReconcileReport) {
+	fmt.Printf("Reconciled media: %d already archived, %d uploaded, %d of deleted messages, %d partial downloads removed, %d recent files skipped, %d with unknown peers skipped, %d failed\n",
+		report.Archived, report.Uploaded, report.Deleted, report.Partial, report.Skipped, report.Unresolved, report.Failed)
+}
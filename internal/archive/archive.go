@@ -0,0 +1,288 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// ChatArchive appends messages to per-chat, per-day JSONL files
+// and periodically uploads them to storage
+type ChatArchive struct {
+	Storage  store.Storage
+	Dir      string
+	Interval time.Duration
+
+	mu    sync.Mutex
+	dirty map[string]bool
+}
+
+// mergeSuffix marks an archive that was started while storage was
+// unavailable and still has to be merged with the stored archive
+const mergeSuffix = ".merge"
+
+// NewChatArchive creates a chat archive that keeps its files in dir
+func NewChatArchive(backend store.Storage, dir string, interval time.Duration) *ChatArchive {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &ChatArchive{
+		Storage:  backend,
+		Dir:      dir,
+		Interval: interval,
+		dirty:    map[string]bool{},
+	}
+}
+
+// ObjectName returns the object name of a chat's archive for a day
+func ObjectName(chatID int64, day time.Time) string {
+	return fmt.Sprintf("%d/messages/%s.jsonl", chatID, day.UTC().Format(time.DateOnly))
+}
+
+// Append adds a record to the archive of its chat and day
+func (a *ChatArchive) Append(ctx context.Context, r Record) error {
+	return a.AppendObject(ctx, ObjectName(r.ChatID, r.Date), r)
+}
+
+// AppendObject adds a JSON line to the archive stored at objectName.
+// The object name must end with the day it covers, as in {YYYY-MM-DD}.jsonl.
+func (a *ChatArchive) AppendObject(ctx context.Context, objectName string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode record: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	path := filepath.Join(a.Dir, filepath.FromSlash(objectName))
+	if err := a.restore(ctx, path, objectName); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+
+	a.dirty[objectName] = true
+	return nil
+}
+
+// restore downloads an already uploaded archive that is missing locally,
+// so appending to it does not overwrite earlier messages
+func (a *ChatArchive) restore(ctx context.Context, path, objectName string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("create archive directory: %w", err)
+	}
+
+	data, err := a.download(ctx, objectName)
+	if errors.Is(err, store.ErrUnavailable) {
+		// Messages are kept locally until the stored archive can be merged
+		if err := os.WriteFile(path+mergeSuffix, nil, 0644); err != nil {
+			return fmt.Errorf("mark archive for merge: %w", err)
+		}
+		return nil
+	}
+	if err != nil || data == nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("restore archive: %w", err)
+	}
+	return nil
+}
+
+// download returns the stored archive, or nil when there is none
+func (a *ChatArchive) download(ctx context.Context, objectName string) ([]byte, error) {
+	exists, err := a.Storage.ObjectExists(ctx, objectName)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	reader, err := a.Storage.DownloadFile(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("download archive %s: %w", objectName, err)
+	}
+	return data, nil
+}
+
+// mergeStored puts the stored archive in front of an archive appended to
+// while storage was unavailable and returns the merged snapshot
+func (a *ChatArchive) mergeStored(ctx context.Context, objectName string, snapshot []byte) ([]byte, error) {
+	stored, err := a.download(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Messages may have been appended since the snapshot was taken
+	path := filepath.Join(a.Dir, filepath.FromSlash(objectName))
+	local, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read archive: %w", err)
+	}
+	if len(stored) > 0 {
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, append(stored, local...), 0644); err != nil {
+			return nil, fmt.Errorf("merge archive: %w", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("merge archive: %w", err)
+		}
+	}
+	if err := os.Remove(path + mergeSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("merge archive: %w", err)
+	}
+
+	return append(stored, snapshot...), nil
+}
+
+// Run flushes the archive periodically until the context is done
+func (a *ChatArchive) Run(ctx context.Context) {
+	if err := a.loadUnmerged(); err != nil {
+		fmt.Printf("Error loading message archive: %v\n", err)
+	}
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Flush(ctx); err != nil {
+				fmt.Printf("Error flushing message archive: %v\n", err)
+			}
+		}
+	}
+}
+
+// loadUnmerged marks archives that still have to be merged as changed, so
+// messages kept during an outage are uploaded after a restart
+func (a *ChatArchive) loadUnmerged() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := filepath.WalkDir(a.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, mergeSuffix) {
+			return err
+		}
+		archivePath := strings.TrimSuffix(path, mergeSuffix)
+		if _, err := os.Stat(archivePath); err != nil {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(a.Dir, archivePath)
+		if err != nil {
+			return err
+		}
+		a.dirty[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Flush uploads every archive changed since the last flush.
+// Local files of past days are removed once uploaded.
+func (a *ChatArchive) Flush(ctx context.Context) error {
+	// Take a snapshot of the changed archives, so appends are not blocked
+	// while they are uploaded
+	a.mu.Lock()
+	snapshots := make(map[string][]byte, len(a.dirty))
+	merge := map[string]bool{}
+	for objectName := range a.dirty {
+		path := filepath.Join(a.Dir, filepath.FromSlash(objectName))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			a.mu.Unlock()
+			return fmt.Errorf("read archive: %w", err)
+		}
+		snapshots[objectName] = data
+		if _, err := os.Stat(path + mergeSuffix); err == nil {
+			merge[objectName] = true
+		}
+	}
+	clear(a.dirty)
+	a.mu.Unlock()
+
+	var errs []error
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly)
+	for objectName, data := range snapshots {
+		var err error
+		if merge[objectName] {
+			data, err = a.mergeStored(ctx, objectName, data)
+		}
+		if err == nil {
+			err = a.upload(ctx, objectName, data)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			a.mu.Lock()
+			a.dirty[objectName] = true
+			a.mu.Unlock()
+			continue
+		}
+
+		// Keep recent days locally as late messages may still arrive
+		day := filepath.Base(objectName)[:len(time.DateOnly)]
+		if day >= yesterday {
+			continue
+		}
+		a.mu.Lock()
+		if !a.dirty[objectName] {
+			path := filepath.Join(a.Dir, filepath.FromSlash(objectName))
+			if err := os.Remove(path); err != nil {
+				fmt.Printf("Error removing archive %s: %v\n", path, err)
+			}
+		}
+		a.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// upload sends a snapshot of an archive to storage
+func (a *ChatArchive) upload(ctx context.Context, objectName string, data []byte) error {
+	_, err := a.Storage.UploadFile(ctx, objectName, bytes.NewReader(data), int64(len(data)), store.UploadOptions{
+		ContentType: "application/x-ndjson",
+	})
+	if err != nil {
+		return fmt.Errorf("upload archive %s: %w", objectName, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// memoryStorage keeps objects in memory and fails while it is down
+type memoryStorage struct {
+	store.Storage
+	objects map[string][]byte
+	down    bool
+}
+
+func (m *memoryStorage) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts store.UploadOptions) (string, error) {
+	if m.down {
+		return "", store.ErrUnavailable
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	m.objects[objectName] = data
+	return "", nil
+}
+
+func (m *memoryStorage) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	if m.down {
+		return nil, store.ErrUnavailable
+	}
+	return io.NopCloser(bytes.NewReader(m.objects[objectName])), nil
+}
+
+func (m *memoryStorage) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	if m.down {
+		return false, store.ErrUnavailable
+	}
+	_, ok := m.objects[objectName]
+	return ok, nil
+}
+
+func TestAppendDuringOutage(t *testing.T) {
+	ctx := context.Background()
+	objectName := ObjectName(1, time.Now())
+	backend := &memoryStorage{
+		objects: map[string][]byte{objectName: []byte("\"stored\"\n")},
+		down:    true,
+	}
+	a := NewChatArchive(backend, t.TempDir(), time.Minute)
+
+	if err := a.AppendObject(ctx, objectName, "first"); err != nil {
+		t.Fatalf("append while storage is down: %v", err)
+	}
+	if err := a.Flush(ctx); err == nil {
+		t.Fatal("flush while storage is down succeeded")
+	}
+
+	// The bot restarts before storage is back
+	a = NewChatArchive(backend, a.Dir, time.Minute)
+	if err := a.loadUnmerged(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AppendObject(ctx, objectName, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend.down = false
+	if err := a.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	want := "\"stored\"\n\"first\"\n\"second\"\n"
+	if got := string(backend.objects[objectName]); got != want {
+		t.Errorf("stored archive is %q, want %q", got, want)
+	}
+
+	// Later flushes do not merge again
+	if err := a.AppendObject(ctx, objectName, "third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(backend.objects[objectName]); got != want+"\"third\"\n" {
+		t.Errorf("stored archive is %q after another flush", got)
+	}
+}
@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// Record is a single archived message
+type Record struct {
+	MessageID  int        `json:"message_id"`
+	Date       time.Time  `json:"date"`
+	EditDate   *time.Time `json:"edit_date,omitempty"`
+	ChatID     int64      `json:"chat_id"`
+	Chat       string     `json:"chat"`
+	SenderID   int64      `json:"sender_id,omitempty"`
+	SenderName string     `json:"sender_name,omitempty"`
+	Out        bool       `json:"out"`
+	Text       string     `json:"text"`
+	Entities   []Entity   `json:"entities,omitempty"`
+	ReplyTo    *Reply     `json:"reply_to,omitempty"`
+	Forward    *Forward   `json:"forward,omitempty"`
+	MediaKey   string     `json:"media_key,omitempty"`
+}
+
+// Entity is a formatting entity of the message text
+type Entity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+	UserID int64  `json:"user_id,omitempty"`
+}
+
+// Reply describes the message being replied to
+type Reply struct {
+	MessageID int   `json:"message_id"`
+	PeerID    int64 `json:"peer_id,omitempty"`
+}
+
+// Forward describes the origin of a forwarded message
+type Forward struct {
+	FromID      int64     `json:"from_id,omitempty"`
+	FromName    string    `json:"from_name,omitempty"`
+	Date        time.Time `json:"date"`
+	ChannelPost int       `json:"channel_post,omitempty"`
+}
+
+// NewRecord builds a record from a message.
+// Entities are used to resolve the sender name, and selfID is the sender of
+// outgoing messages.
+func NewRecord(msg *tg.Message, e tg.Entities, chatID int64, chat string, selfID int64) Record {
+	r := Record{
+		MessageID: msg.ID,
+		Date:      time.Unix(int64(msg.Date), 0).UTC(),
+		ChatID:    chatID,
+		Chat:      chat,
+		Out:       msg.Out,
+		Text:      msg.Message,
+	}
+
+	// Private chats omit the sender of their messages
+	if from, ok := msg.GetFromID(); ok {
+		r.SenderID = PeerID(from)
+	} else if msg.Out {
+		r.SenderID = selfID
+	} else {
+		r.SenderID = chatID
+	}
+	if user, ok := e.Users[r.SenderID]; ok {
+		r.SenderName = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+
+	r.Entities = Entities(msg.Entities)
+	if date, ok := msg.GetEditDate(); ok {
+		edited := time.Unix(int64(date), 0).UTC()
+		r.EditDate = &edited
+	}
+
+	if reply, ok := msg.ReplyTo.(*tg.MessageReplyHeader); ok && reply.ReplyToMsgID != 0 {
+		r.ReplyTo = &Reply{MessageID: reply.ReplyToMsgID}
+		if peer, ok := reply.GetReplyToPeerID(); ok {
+			r.ReplyTo.PeerID = PeerID(peer)
+		}
+	}
+
+	if fwd, ok := msg.GetFwdFrom(); ok {
+		r.Forward = &Forward{
+			FromName:    fwd.FromName,
+			Date:        time.Unix(int64(fwd.Date), 0).UTC(),
+			ChannelPost: fwd.ChannelPost,
+		}
+		if from, ok := fwd.GetFromID(); ok {
+			r.Forward.FromID = PeerID(from)
+		}
+	}
+
+	return r
+}
+
+// Entities converts message entities to their archived form
+func Entities(entities []tg.MessageEntityClass) []Entity {
+	var result []Entity
+	for _, entity := range entities {
+		ent := Entity{
+			Type:   strings.TrimPrefix(entity.TypeName(), "messageEntity"),
+			Offset: entity.GetOffset(),
+			Length: entity.GetLength(),
+		}
+		switch en := entity.(type) {
+		case *tg.MessageEntityTextURL:
+			ent.URL = en.URL
+		case *tg.MessageEntityMentionName:
+			ent.UserID = en.UserID
+		}
+		result = append(result, ent)
+	}
+	return result
+}
+
+// PeerID returns the numeric ID of a peer
+func PeerID(p tg.PeerClass) int64 {
+	switch peer := p.(type) {
+	case *tg.PeerUser:
+		return peer.UserID
+	case *tg.PeerChat:
+		return peer.ChatID
+	case *tg.PeerChannel:
+		return peer.ChannelID
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+package archive
+
+import (
+	"strings"
+	"time"
+)
+
+// SidecarSuffix is appended to an object name to get its sidecar
+const SidecarSuffix = ".meta.json"
+
+// Sidecar holds the message details of an archived media object.
+// It is stored next to the object and updated when the caption is edited.
+type Sidecar struct {
+	Key       string     `json:"key"`
+	MessageID int        `json:"message_id"`
+	PeerID    int64      `json:"peer_id"`
+	Username  string     `json:"username"`
+	Date      time.Time  `json:"date"`
+	EditDate  *time.Time `json:"edit_date,omitempty"`
+	MediaID   int64      `json:"media_id,omitempty"`
+	Version   int        `json:"version"`
+	Caption   string     `json:"caption"`
+	Entities  []Entity   `json:"entities,omitempty"`
+}
+
+// SidecarKey returns the object name of the sidecar of an object
+func SidecarKey(objectName string) string {
+	return objectName + SidecarSuffix
+}
+
+// IsSidecar reports whether an object name refers to a sidecar
+func IsSidecar(objectName string) bool {
+	return strings.HasSuffix(objectName, SidecarSuffix)
+}
@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaCache keeps downloaded media files in the media directory within a
+// size and age limit. Only files confirmed to be uploaded are evicted, least
+// recently used first, and only they count towards the size limit.
+type MediaCache struct {
+	Dir     string
+	MaxSize int64
+	MaxAge  time.Duration
+	// MinFree is the free disk space below which downloads are paused
+	MinFree int64
+
+	mu    sync.Mutex
+	files map[string]*cachedFile
+	// size is the total size of the uploaded files
+	size int64
+}
+
+// cachedFile is a file in the media directory
+type cachedFile struct {
+	path     string
+	size     int64
+	used     time.Time
+	archived bool
+	// pins counts uploads using the file, which is not evicted meanwhile
+	pins int
+}
+
+// New creates a cache for the media directory
+func New(dir string, maxSize int64, maxAge time.Duration, minFree int64) *MediaCache {
+	return &MediaCache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		MinFree: minFree,
+		files:   map[string]*cachedFile{},
+	}
+}
+
+// Load adds the files already in the media directory. Their upload state is
+// unknown, so they are not evicted until they are confirmed with Archived.
+func (c *MediaCache) Load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == c.Dir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".part") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		c.add(path, info.Size(), info.ModTime(), false)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load media cache: %w", err)
+	}
+	return nil
+}
+
+// add records a file; c.mu must be held
+func (c *MediaCache) add(path string, size int64, used time.Time, archived bool) {
+	c.remove(path)
+	c.files[path] = &cachedFile{path: path, size: size, used: used, archived: archived}
+	if archived {
+		c.size += size
+	}
+}
+
+// remove forgets a file; c.mu must be held
+func (c *MediaCache) remove(path string) {
+	f, ok := c.files[path]
+	if !ok {
+		return
+	}
+	if f.archived {
+		c.size -= f.size
+	}
+	delete(c.files, path)
+}
+
+// Track records a newly downloaded file, which is not uploaded yet. The file
+// is pinned until it is passed to Archived or Release.
+func (c *MediaCache) Track(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pins := 0
+	if f, ok := c.files[path]; ok {
+		pins = f.pins
+	}
+	c.add(path, info.Size(), time.Now(), false)
+	c.files[path].pins = pins + 1
+}
+
+// Archived marks a file as uploaded, making it eligible for eviction once it
+// is no longer pinned, and evicts files if the cache is over its limits
+func (c *MediaCache) Archived(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	pins := 0
+	if f, ok := c.files[path]; ok {
+		pins = max(f.pins-1, 0)
+	}
+	c.add(path, info.Size(), time.Now(), true)
+	c.files[path].pins = pins
+	c.mu.Unlock()
+
+	c.Evict()
+}
+
+// Release unpins a file whose upload did not complete
+func (c *MediaCache) Release(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.files[path]; ok && f.pins > 0 {
+		f.pins--
+	}
+}
+
+// Lookup reports whether a file of the given size is cached. A cached file is
+// pinned until it is passed to Archived or Release.
+func (c *MediaCache) Lookup(path string, size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[path]
+	if !ok || f.size != size {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		c.remove(path)
+		return false
+	}
+	f.used = time.Now()
+	f.pins++
+	return true
+}
+
+// Size returns the bytes of uploaded files held by the cache
+func (c *MediaCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Evict removes uploaded files older than the maximum age, then the least
+// recently used uploaded files while the cache is too large or disk space is
+// low. Pinned files are skipped.
+func (c *MediaCache) Evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var candidates []*cachedFile
+	for _, f := range c.files {
+		if f.archived && f.pins == 0 {
+			candidates = append(candidates, f)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].used.Before(candidates[j].used) })
+
+	evicted := 0
+	for _, f := range candidates {
+		expired := c.MaxAge > 0 && time.Since(f.used) > c.MaxAge
+		tooLarge := c.MaxSize > 0 && c.size > c.MaxSize
+		if !expired && !tooLarge && !c.lowDisk() {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error evicting %s from media cache: %v\n", f.path, err)
+			continue
+		}
+		c.remove(f.path)
+		evicted++
+	}
+	if evicted > 0 {
+		fmt.Printf("Evicted %d files from media cache, %d bytes cached\n", evicted, c.size)
+	}
+}
+
+// lowDisk reports whether free disk space is below the watermark
+func (c *MediaCache) lowDisk() bool {
+	if c.MinFree <= 0 {
+		return false
+	}
+	free, err := freeSpace(c.Dir)
+	return err == nil && free < c.MinFree
+}
+
+// WaitForSpace blocks new downloads while free disk space is below the
+// watermark, evicting uploaded files to make room
+func (c *MediaCache) WaitForSpace(ctx context.Context) error {
+	if c.MinFree <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	paused := false
+	for {
+		c.Evict()
+
+		c.mu.Lock()
+		low := c.lowDisk()
+		c.mu.Unlock()
+		if !low {
+			if paused {
+				fmt.Println("Disk space recovered, resuming downloads")
+			}
+			return nil
+		}
+		if !paused {
+			fmt.Println("Disk space is low, pausing downloads")
+			paused = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run evicts expired files every interval until the context is cancelled
+func (c *MediaCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Evict()
+		}
+	}
+}
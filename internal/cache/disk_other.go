@@ -0,0 +1,10 @@
+//go:build !unix
+
+package cache
+
+import "errors"
+
+// freeSpace is not supported on this platform, so the watermark is never reached
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
@@ -31,12 +31,12 @@ type Setup struct {
 }
 
 // NewClient initializes a new Telegram client with all necessary components
-func NewClient(appID string, appHash string, storageSetup *store.Setup, logger *zap.Logger) (*Setup, error) {
+func NewClient(appID string, appHash string, storageSetup *store.Setup, peers storage.PeerStorage, logger *zap.Logger) (*Setup, error) {
 	// Create update dispatcher
 	dispatcher := tg.NewUpdateDispatcher()
 
 	// Set up update handler with peer storage
-	updateHandler := storage.UpdateHook(dispatcher, storageSetup.PeerDB)
+	updateHandler := storage.UpdateHook(dispatcher, peers)
 
 	// Set up updates manager for recovery
 	updatesManager := updates.New(updates.Config{
@@ -74,7 +74,7 @@ func NewClient(appID string, appHash string, storageSetup *store.Setup, logger *
 	api := client.API()
 
 	// Create resolver with peer storage
-	resolver := storage.NewResolverCache(peer.Plain(api), storageSetup.PeerDB)
+	resolver := storage.NewResolverCache(peer.Plain(api), peers)
 
 	// Create sender
 	sender := message.NewSender(api)
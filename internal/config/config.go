@@ -3,11 +3,105 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+// Message directions that can be archived
+const (
+	DirectionAll      = "all"
+	DirectionIncoming = "incoming"
+	DirectionOutgoing = "outgoing"
+	DirectionSplit    = "split"
+)
+
+// Actions taken on archived objects when their message is deleted
+const (
+	DeleteModeTag    = "tag"
+	DeleteModeTrash  = "trash"
+	DeleteModeDelete = "delete"
+	DeleteModeNone   = "none"
+)
+
+// Encryption modes for archived files
+const (
+	EncryptionNone   = "none"
+	EncryptionClient = "client"
+	EncryptionSSEC   = "sse-c"
+)
+
+// CompressionNone disables compression of archived files
+const CompressionNone = "none"
+
+// Storage target modes
+const (
+	TargetRequired   = "required"
+	TargetBestEffort = "best-effort"
+)
+
+// StorageTarget is an additional S3-compatible bucket archived files are replicated to
+type StorageTarget struct {
+	Name      string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	SSL       bool
+	Region    string
+	Mode      string
+
+	// ObjectLocking creates the bucket with object locking enabled
+	ObjectLocking bool
+}
+
+// LifecycleRule applies a lifecycle action to objects a number of days after upload
+type LifecycleRule struct {
+	// Selector is a key prefix ending in "/", a media type such as "video",
+	// or "*" for all objects
+	Selector string
+	Days     int
+}
+
+// BucketPolicy is the declared lifecycle and retention configuration of the bucket
+type BucketPolicy struct {
+	Expire                 []LifecycleRule
+	Transition             []LifecycleRule
+	TransitionStorageClass string
+	AbortMultipartDays     int
+	Versioning             bool
+	ObjectLockMode         string
+	ObjectLockDays         int
+}
+
+// Actions taken when a peer exceeds its hard quota
+const (
+	QuotaSkip  = "skip"
+	QuotaRoute = "route"
+)
+
+// Quota limits the bytes stored for a peer; zero means unlimited
+type Quota struct {
+	Soft int64
+	Hard int64
+}
+
+// PeerQuota overrides the default quota for a USER_TARGET style peer reference
+type PeerQuota struct {
+	Target string
+	Quota
+}
+
+// QuotaConfig holds the storage quotas of archived peers
+type QuotaConfig struct {
+	Default     Quota
+	Peers       []PeerQuota
+	HardAction  string
+	RoutePrefix string
+}
+
 type Config struct {
 	Phone      string
 	AppID      string
@@ -23,9 +117,64 @@ type Config struct {
 	MinioRegion    string
 	MinioEndpoint  string
 
+	StorageBackend     string
+	LocalStorageDir    string
+	LocalStorageAddr   string
+	LocalStorageURL    string
+	LocalStorageSecret string
+
+	BucketPolicy BucketPolicy
+
+	StorageTargets      []StorageTarget
+	ReplicationInterval time.Duration
+
+	SpoolMaxSize     int64
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	DegradedStartup  bool
+
+	BatchUploads    bool
+	BatchWindow     time.Duration
+	BatchMaxSize    int64
+	BatchMaxObjects int
+
+	MultipartThreshold    int64
+	UploadThreads         int
+	UploadBufferMemory    int64
+	UploadStaleAfter      time.Duration
+	UploadCleanupInterval time.Duration
+
+	Encryption             string
+	EncryptionMasterKey    string
+	EncryptionRecipients   []string
+	EncryptionIdentityFile string
+
+	Compression      string
+	CompressionTypes []string
+
 	AUTO_REMOVE_MEDIA  bool
 	WORKER_POOL        string
 	SEND_INFO_UPLOADED bool
+	VerifyDownloads    bool
+	ReconcileMedia     bool
+
+	MediaCacheSize   int64
+	MediaCacheMaxAge time.Duration
+	MediaMinFreeDisk int64
+
+	PreviewSizes      []int
+	ObjectKeyTemplate string
+	ExifMetadata      bool
+	StripExif         bool
+
+	ArchiveMessages      bool
+	ArchiveFlushInterval time.Duration
+
+	Quota QuotaConfig
+
+	DeleteMode       string
+	MessageDirection string
+	WarmupDialogs    bool
 }
 
 // LoadConfig loads configuration from environment variables.
@@ -35,12 +184,13 @@ func LoadConfig() Config {
 		fmt.Fprintf(os.Stderr, "Warning: Error loading .env file: %v\n", err)
 	}
 
-	// Split USER_TARGET by comma to convert string to []string
-	userTargets := strings.Split(os.Getenv("USER_TARGET"), ",")
-
-	// Trim spaces from each target
-	for i, target := range userTargets {
-		userTargets[i] = strings.TrimSpace(target)
+	// Split USER_TARGET by comma to convert string to []string,
+	// skipping blank entries so an empty value means all users
+	var userTargets []string
+	for _, target := range strings.Split(os.Getenv("USER_TARGET"), ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			userTargets = append(userTargets, target)
+		}
 	}
 
 	return Config{
@@ -58,8 +208,264 @@ func LoadConfig() Config {
 		MinioRegion:    os.Getenv("MINIO_REGION"),
 		MinioEndpoint:  os.Getenv("MINIO_ENDPOINT"),
 
+		StorageBackend:     getEnv("STORAGE_BACKEND", "minio"),
+		LocalStorageDir:    getEnv("LOCAL_STORAGE_DIR", "storage"),
+		LocalStorageAddr:   getEnv("LOCAL_STORAGE_ADDR", ":8080"),
+		LocalStorageURL:    getEnv("LOCAL_STORAGE_URL", "http://localhost:8080"),
+		LocalStorageSecret: os.Getenv("LOCAL_STORAGE_SECRET"),
+
+		BucketPolicy: BucketPolicy{
+			Expire:                 parseLifecycleRules(os.Getenv("LIFECYCLE_EXPIRE")),
+			Transition:             parseLifecycleRules(os.Getenv("LIFECYCLE_TRANSITION")),
+			TransitionStorageClass: os.Getenv("LIFECYCLE_TRANSITION_CLASS"),
+			AbortMultipartDays:     parseInt(os.Getenv("LIFECYCLE_ABORT_MULTIPART_DAYS")),
+			Versioning:             os.Getenv("BUCKET_VERSIONING") == "true",
+			ObjectLockMode:         strings.ToUpper(strings.TrimSpace(os.Getenv("OBJECT_LOCK_MODE"))),
+			ObjectLockDays:         parseInt(os.Getenv("OBJECT_LOCK_DAYS")),
+		},
+
+		StorageTargets:      parseStorageTargets(os.Getenv("STORAGE_TARGETS")),
+		ReplicationInterval: parseDuration(os.Getenv("REPLICATION_INTERVAL"), 15*time.Minute),
+
+		SpoolMaxSize:     parseSize(getEnv("SPOOL_MAX_SIZE", "1GB")),
+		BreakerThreshold: parseInt(getEnv("BREAKER_THRESHOLD", "5")),
+		BreakerCooldown:  parseDuration(os.Getenv("BREAKER_COOLDOWN"), 30*time.Second),
+		DegradedStartup:  os.Getenv("DEGRADED_STARTUP") == "true",
+
+		BatchUploads:    os.Getenv("BATCH_UPLOADS") == "true",
+		BatchWindow:     parseDuration(os.Getenv("BATCH_WINDOW"), 2*time.Second),
+		BatchMaxSize:    parseSize(getEnv("BATCH_MAX_SIZE", "1MB")),
+		BatchMaxObjects: parseInt(os.Getenv("BATCH_MAX_OBJECTS")),
+
+		MultipartThreshold:    parseSize(getEnv("MULTIPART_THRESHOLD", "50MB")),
+		UploadThreads:         parseInt(getEnv("UPLOAD_THREADS", "4")),
+		UploadBufferMemory:    parseSize(getEnv("UPLOAD_BUFFER_MEMORY", "256MB")),
+		UploadStaleAfter:      parseDuration(os.Getenv("UPLOAD_STALE_AFTER"), 24*time.Hour),
+		UploadCleanupInterval: parseDuration(os.Getenv("UPLOAD_CLEANUP_INTERVAL"), time.Hour),
+
+		Encryption:             getEnv("ENCRYPTION", EncryptionNone),
+		EncryptionMasterKey:    os.Getenv("ENCRYPTION_MASTER_KEY"),
+		EncryptionRecipients:   parseList(os.Getenv("ENCRYPTION_RECIPIENTS")),
+		EncryptionIdentityFile: os.Getenv("ENCRYPTION_IDENTITY_FILE"),
+
+		Compression:      getEnv("COMPRESSION", CompressionNone),
+		CompressionTypes: parseList(os.Getenv("COMPRESSION_TYPES")),
+
 		AUTO_REMOVE_MEDIA:  os.Getenv("AUTO_REMOVE_MEDIA") == "true",
 		WORKER_POOL:        os.Getenv("WORKER_POOL"),
 		SEND_INFO_UPLOADED: os.Getenv("SEND_INFO_UPLOADED") == "true",
+		VerifyDownloads:    os.Getenv("VERIFY_DOWNLOADS") == "true",
+		ReconcileMedia:     os.Getenv("RECONCILE_MEDIA") == "true",
+
+		MediaCacheSize:   parseSize(os.Getenv("MEDIA_CACHE_SIZE")),
+		MediaCacheMaxAge: parseDuration(os.Getenv("MEDIA_CACHE_MAX_AGE"), 0),
+		MediaMinFreeDisk: parseSize(os.Getenv("MEDIA_MIN_FREE_DISK")),
+
+		PreviewSizes:      parseIntList(os.Getenv("PREVIEW_SIZES")),
+		ObjectKeyTemplate: os.Getenv("OBJECT_KEY_TEMPLATE"),
+		ExifMetadata:      os.Getenv("EXIF_METADATA") == "true",
+		StripExif:         os.Getenv("STRIP_EXIF") == "true",
+
+		ArchiveMessages:      os.Getenv("ARCHIVE_MESSAGES") == "true",
+		ArchiveFlushInterval: parseDuration(os.Getenv("ARCHIVE_FLUSH_INTERVAL"), time.Minute),
+
+		Quota: QuotaConfig{
+			Default: Quota{
+				Soft: parseSize(os.Getenv("QUOTA_SOFT")),
+				Hard: parseSize(os.Getenv("QUOTA_HARD")),
+			},
+			Peers:       parsePeerQuotas(os.Getenv("QUOTA_PEERS")),
+			HardAction:  getEnv("QUOTA_HARD_ACTION", QuotaSkip),
+			RoutePrefix: getEnv("QUOTA_ROUTE_PREFIX", "overflow"),
+		},
+
+		DeleteMode:       getEnv("DELETE_MODE", DeleteModeTag),
+		MessageDirection: getEnv("MESSAGE_DIRECTION", DirectionAll),
+		WarmupDialogs:    os.Getenv("WARMUP_DIALOGS") == "true",
+	}
+}
+
+// Validate reports settings that would otherwise be silently ignored
+func (c Config) Validate() error {
+	switch c.MessageDirection {
+	case DirectionAll, DirectionIncoming, DirectionOutgoing:
+	case DirectionSplit:
+		if c.ObjectKeyTemplate != "" && !strings.Contains(c.ObjectKeyTemplate, "{direction}") {
+			return fmt.Errorf("MESSAGE_DIRECTION=split needs {direction} in OBJECT_KEY_TEMPLATE")
+		}
+	default:
+		return fmt.Errorf("unknown MESSAGE_DIRECTION %q", c.MessageDirection)
+	}
+
+	switch c.Quota.HardAction {
+	case QuotaSkip, QuotaRoute:
+	default:
+		return fmt.Errorf("unknown QUOTA_HARD_ACTION %q", c.Quota.HardAction)
+	}
+
+	switch c.DeleteMode {
+	case DeleteModeTag, DeleteModeTrash, DeleteModeDelete, DeleteModeNone:
+	default:
+		return fmt.Errorf("unknown DELETE_MODE %q", c.DeleteMode)
+	}
+
+	if c.WORKER_POOL != "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(c.WORKER_POOL)); err != nil || n <= 0 {
+			return fmt.Errorf("WORKER_POOL must be a positive number, got %q", c.WORKER_POOL)
+		}
+	}
+
+	// Every upload waits for its batch, so a batch never holds more files than uploads run at once
+	if c.BatchUploads && c.BatchMaxObjects > c.WorkerPoolSize() {
+		return fmt.Errorf("BATCH_MAX_OBJECTS (%d) cannot exceed WORKER_POOL (%d)", c.BatchMaxObjects, c.WorkerPoolSize())
+	}
+
+	return nil
+}
+
+// WorkerPoolSize returns how many messages are processed at once, 5 unless WORKER_POOL is set
+func (c Config) WorkerPoolSize() int {
+	n, err := strconv.Atoi(strings.TrimSpace(c.WORKER_POOL))
+	if err != nil || n <= 0 {
+		return 5
+	}
+	return n
+}
+
+// getEnv returns the value of an environment variable or fallback when it is empty
+func getEnv(key, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseDuration parses a duration such as "30s" or "5m", returning fallback when it is empty or invalid
+func parseDuration(value string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+// parseIntList parses a comma separated list of positive integers,
+// skipping entries that are empty or invalid.
+func parseIntList(value string) []int {
+	var result []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n <= 0 {
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// parseStorageTargets reads the settings of each comma separated target name
+// from TARGET_<NAME>_* variables
+func parseStorageTargets(value string) []StorageTarget {
+	var targets []StorageTarget
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "TARGET_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+		targets = append(targets, StorageTarget{
+			Name:      name,
+			Endpoint:  os.Getenv(prefix + "ENDPOINT"),
+			AccessKey: os.Getenv(prefix + "ACCESS_KEY"),
+			SecretKey: os.Getenv(prefix + "SECRET_KEY"),
+			Bucket:    os.Getenv(prefix + "BUCKET"),
+			SSL:       os.Getenv(prefix+"SSL") == "true",
+			Region:    os.Getenv(prefix + "REGION"),
+			Mode:      getEnv(prefix+"MODE", TargetBestEffort),
+		})
+	}
+	return targets
+}
+
+// parseList parses a comma separated list, skipping blank entries
+func parseList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseInt parses a non-negative integer, returning 0 when it is empty or invalid
+func parseInt(value string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// parseLifecycleRules parses a comma separated list of selector=days pairs,
+// skipping entries that are empty or invalid
+func parseLifecycleRules(value string) []LifecycleRule {
+	var rules []LifecycleRule
+	for _, item := range parseList(value) {
+		selector, days, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if !ok || err != nil || n <= 0 || strings.TrimSpace(selector) == "" {
+			continue
+		}
+		rules = append(rules, LifecycleRule{Selector: strings.TrimSpace(selector), Days: n})
+	}
+	return rules
+}
+
+// parseSize parses a byte size such as "500MB" or "10GB" using binary units,
+// returning 0 when it is empty or invalid
+func parseSize(value string) int64 {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return int64(n * float64(multiplier))
+}
+
+// parsePeerQuotas parses a comma separated list of target=soft/hard entries,
+// where either limit may be left empty
+func parsePeerQuotas(value string) []PeerQuota {
+	var quotas []PeerQuota
+	for _, item := range parseList(value) {
+		target, limits, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(target) == "" {
+			continue
+		}
+		soft, hard, _ := strings.Cut(limits, "/")
+		quotas = append(quotas, PeerQuota{
+			Target: strings.TrimSpace(target),
+			Quota:  Quota{Soft: parseSize(soft), Hard: parseSize(hard)},
+		})
 	}
+	return quotas
 }
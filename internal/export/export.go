@@ -0,0 +1,345 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// Exporter builds Telegram Desktop exports from archived objects
+type Exporter struct {
+	Storage store.Storage
+
+	// PeerID limits the export to the message archive and media of one peer
+	// when set. Media without a Peer-Id are left out.
+	PeerID int64
+
+	// Exclude lists key prefixes left out of the export
+	Exclude []string
+}
+
+// NewExporter creates a new exporter
+func NewExporter(backend store.Storage) *Exporter {
+	return &Exporter{Storage: backend}
+}
+
+// Export writes result.json and the media of all objects under the prefixes to outDir
+func (e *Exporter) Export(ctx context.Context, prefixes []string, name, outDir string) (*Chat, error) {
+	objects, err := e.list(ctx, prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message archives hold the conversation, everything else is media
+	records := map[int]archive.Record{}
+	sidecars := map[string]archive.Sidecar{}
+	var mediaObjects []store.ObjectInfo
+	for _, obj := range objects {
+		switch {
+		case path.Base(path.Dir(obj.Key)) == "messages" && strings.HasSuffix(obj.Key, ".jsonl"):
+			if e.PeerID != 0 && path.Dir(obj.Key) != fmt.Sprintf("%d/messages", e.PeerID) {
+				continue
+			}
+			if err := e.readRecords(ctx, obj.Key, records); err != nil {
+				return nil, err
+			}
+		case archive.IsSidecar(obj.Key):
+			sidecar, err := e.readSidecar(ctx, obj.Key)
+			if err != nil {
+				return nil, err
+			}
+			sidecars[sidecar.Key] = sidecar
+		default:
+			mediaObjects = append(mediaObjects, obj)
+		}
+	}
+
+	chat := &Chat{Name: name, Type: "personal_chat"}
+	messages := map[int]*Message{}
+	for id, r := range records {
+		messages[id] = messageFromRecord(r)
+		if chat.ID == 0 {
+			chat.ID = r.ChatID
+		}
+	}
+
+	// Attach media to their messages, creating messages for media without a record
+	usedNames := map[string]bool{}
+	nextID := -1
+	for _, obj := range mediaObjects {
+		info, err := e.Storage.GetObjectInfo(ctx, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		if e.PeerID != 0 && info.UserMetadata["Peer-Id"] != strconv.FormatInt(e.PeerID, 10) {
+			continue
+		}
+
+		id, err := strconv.Atoi(info.UserMetadata["Message-Id"])
+		if err != nil {
+			id = nextID
+			nextID--
+		}
+		msg, ok := messages[id]
+		if !ok {
+			date := info.LastModified
+			if t, err := time.Parse(time.RFC3339, info.UserMetadata["Message-Date"]); err == nil {
+				date = t
+			}
+			msg = &Message{ID: id, Type: "message", TextEntities: []TextEntity{}}
+			setDate(msg, date)
+			messages[id] = msg
+
+			// Without a message archive the caption comes from the sidecar
+			if sidecar, ok := sidecars[obj.Key]; ok {
+				msg.Text = sidecar.Caption
+				msg.TextEntities = textEntities(sidecar.Caption, sidecar.Entities)
+			}
+		}
+		if chat.ID == 0 {
+			chat.ID, _ = strconv.ParseInt(info.UserMetadata["Peer-Id"], 10, 64)
+		}
+
+		rel, err := e.download(ctx, info, outDir, usedNames)
+		if err != nil {
+			return nil, err
+		}
+		setMedia(msg, info, rel)
+	}
+
+	for _, msg := range messages {
+		chat.Messages = append(chat.Messages, *msg)
+	}
+	sort.Slice(chat.Messages, func(i, j int) bool {
+		a, _ := strconv.ParseInt(chat.Messages[i].DateUnixtime, 10, 64)
+		b, _ := strconv.ParseInt(chat.Messages[j].DateUnixtime, 10, 64)
+		if a != b {
+			return a < b
+		}
+		return chat.Messages[i].ID < chat.Messages[j].ID
+	})
+
+	data, err := json.MarshalIndent(chat, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("encode result: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "result.json"), data, 0644); err != nil {
+		return nil, fmt.Errorf("write result: %w", err)
+	}
+
+	return chat, nil
+}
+
+// list returns the objects under the prefixes once each, leaving out excluded keys
+func (e *Exporter) list(ctx context.Context, prefixes []string) ([]store.ObjectInfo, error) {
+	seen := map[string]bool{}
+	var objects []store.ObjectInfo
+	for _, prefix := range prefixes {
+		listed, err := e.Storage.ListFiles(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range listed {
+			if seen[obj.Key] || e.excluded(obj.Key) {
+				continue
+			}
+			seen[obj.Key] = true
+			objects = append(objects, obj)
+		}
+	}
+	return objects, nil
+}
+
+// excluded reports whether a key is under one of the excluded prefixes
+func (e *Exporter) excluded(key string) bool {
+	for _, prefix := range e.Exclude {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRecords parses a JSONL message archive into records keyed by message ID
+func (e *Exporter) readRecords(ctx context.Context, objectName string, records map[int]archive.Record) error {
+	reader, err := e.Storage.DownloadFile(ctx, objectName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r archive.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("parse %s: %w", objectName, err)
+		}
+		records[r.MessageID] = r
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", objectName, err)
+	}
+	return nil
+}
+
+// readSidecar downloads the sidecar stored at objectName
+func (e *Exporter) readSidecar(ctx context.Context, objectName string) (archive.Sidecar, error) {
+	var sidecar archive.Sidecar
+	reader, err := e.Storage.DownloadFile(ctx, objectName)
+	if err != nil {
+		return sidecar, err
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(&sidecar); err != nil {
+		return sidecar, fmt.Errorf("parse %s: %w", objectName, err)
+	}
+	return sidecar, nil
+}
+
+// download saves an object in the export directory for its media type
+// and returns its path relative to the export root
+func (e *Exporter) download(ctx context.Context, info store.ObjectInfo, outDir string, usedNames map[string]bool) (string, error) {
+	layout, ok := mediaLayout[info.UserMetadata["Media-Type"]]
+	if !ok {
+		layout = mediaLayout["document"]
+	}
+
+	// Keep file names unique within the export
+	name := path.Base(info.Key)
+	rel := path.Join(layout.Dir, name)
+	for i := 1; usedNames[rel]; i++ {
+		rel = path.Join(layout.Dir, fmt.Sprintf("%d_%s", i, name))
+	}
+	usedNames[rel] = true
+
+	target := filepath.Join(outDir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", fmt.Errorf("create directory: %w", err)
+	}
+
+	reader, err := e.Storage.DownloadFile(ctx, info.Key)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	file, err := os.Create(target)
+	if err != nil {
+		return "", fmt.Errorf("create file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, reader); err != nil {
+		return "", fmt.Errorf("download %s: %w", info.Key, err)
+	}
+	return rel, nil
+}
+
+// messageFromRecord converts an archived message to the export format
+func messageFromRecord(r archive.Record) *Message {
+	msg := &Message{
+		ID:           r.MessageID,
+		Type:         "message",
+		From:         r.SenderName,
+		Text:         r.Text,
+		TextEntities: textEntities(r.Text, r.Entities),
+	}
+	setDate(msg, r.Date)
+	if r.SenderID != 0 {
+		msg.FromID = fmt.Sprintf("user%d", r.SenderID)
+	}
+	if r.ReplyTo != nil {
+		msg.ReplyToMessageID = r.ReplyTo.MessageID
+	}
+	if r.Forward != nil {
+		msg.ForwardedFrom = r.Forward.FromName
+		if msg.ForwardedFrom == "" && r.Forward.FromID != 0 {
+			msg.ForwardedFrom = strconv.FormatInt(r.Forward.FromID, 10)
+		}
+	}
+	return msg
+}
+
+// setDate sets both date fields of a message
+func setDate(msg *Message, date time.Time) {
+	msg.Date = date.Local().Format("2006-01-02T15:04:05")
+	msg.DateUnixtime = strconv.FormatInt(date.Unix(), 10)
+}
+
+// setMedia fills the media fields of a message from object metadata
+func setMedia(msg *Message, info store.ObjectInfo, rel string) {
+	meta := info.UserMetadata
+	mediaType := meta["Media-Type"]
+	msg.Width, _ = strconv.Atoi(meta["Width"])
+	msg.Height, _ = strconv.Atoi(meta["Height"])
+	if mediaType == "photo" {
+		msg.Photo = rel
+		return
+	}
+
+	msg.File = rel
+	msg.MediaType = mediaLayout[mediaType].MediaType
+	msg.MimeType = info.ContentType
+	if duration, err := strconv.ParseFloat(meta["Duration"], 64); err == nil {
+		msg.DurationSeconds = int(duration)
+	}
+	msg.Performer = decodeMetadata(meta["Performer"])
+	msg.Title = decodeMetadata(meta["Title"])
+}
+
+// decodeMetadata decodes values stored as RFC 2047 encoded words
+func decodeMetadata(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// ZipDir writes the contents of dir as a zip archive to w
+func ZipDir(dir string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		entry, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("create zip: %w", err)
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,149 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/media"
+)
+
+// ExportedChat is a chat read from a Telegram Desktop export
+type ExportedChat struct {
+	Name string
+	ID   int64
+	// Channel is set for channels and supergroups, which number their
+	// messages separately
+	Channel bool
+	Media   []ExportedMedia
+}
+
+// ExportedMedia is a media file of an exported message
+type ExportedMedia struct {
+	Path      string
+	Kind      string
+	Attrs     media.Attributes
+	MessageID int
+	Date      time.Time
+	// FromID is the sender in export form, such as user123
+	FromID string
+}
+
+// exportedMessage holds the fields read from exported messages.
+// Text is left out as it may be a string or a list of entities.
+type exportedMessage struct {
+	ID              int    `json:"id"`
+	Type            string `json:"type"`
+	Date            string `json:"date"`
+	DateUnixtime    string `json:"date_unixtime"`
+	FromID          string `json:"from_id"`
+	Photo           string `json:"photo"`
+	File            string `json:"file"`
+	MediaType       string `json:"media_type"`
+	MimeType        string `json:"mime_type"`
+	DurationSeconds int    `json:"duration_seconds"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	Performer       string `json:"performer"`
+	Title           string `json:"title"`
+}
+
+// attributeTypes maps export media types to attribute types
+var attributeTypes = map[string]string{
+	"video_file":    "video",
+	"animation":     "video",
+	"video_message": "round",
+	"voice_message": "voice",
+	"audio_file":    "audio",
+}
+
+// channelTypes are the export chat types of channels and supergroups
+var channelTypes = map[string]bool{
+	"public_channel":     true,
+	"private_channel":    true,
+	"public_supergroup":  true,
+	"private_supergroup": true,
+}
+
+// ReadExport parses result.json of a single chat export in dir.
+// Media that were not included in the export are skipped.
+func ReadExport(dir string) (*ExportedChat, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "result.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read result: %w", err)
+	}
+
+	var result struct {
+		Name     string            `json:"name"`
+		Type     string            `json:"type"`
+		ID       int64             `json:"id"`
+		Messages []exportedMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("parse result: %w", err)
+	}
+
+	chat := &ExportedChat{Name: result.Name, ID: result.ID, Channel: channelTypes[result.Type]}
+	for _, msg := range result.Messages {
+		if msg.Type != "message" {
+			continue
+		}
+
+		m := ExportedMedia{MessageID: msg.ID, Date: exportDate(msg), FromID: msg.FromID}
+		switch {
+		case msg.Photo != "":
+			m.Path = msg.Photo
+			m.Kind = "photo"
+			m.Attrs = media.Attributes{Type: "photo", MimeType: "image/jpeg", Width: msg.Width, Height: msg.Height}
+		case msg.File != "":
+			m.Path = msg.File
+			m.Kind = "document"
+			m.Attrs = media.Attributes{
+				Type:      "document",
+				MimeType:  msg.MimeType,
+				FileName:  filepath.Base(msg.File),
+				Duration:  float64(msg.DurationSeconds),
+				Width:     msg.Width,
+				Height:    msg.Height,
+				Title:     msg.Title,
+				Performer: msg.Performer,
+			}
+			if t, ok := attributeTypes[msg.MediaType]; ok {
+				m.Attrs.Type = t
+			}
+			if m.Attrs.Type == "video" || m.Attrs.Type == "round" {
+				m.Kind = "video"
+			}
+		default:
+			continue
+		}
+
+		// Skipped files are replaced by a note such as "(File not included...)"
+		if strings.HasPrefix(m.Path, "(") {
+			continue
+		}
+		m.Path = filepath.Join(dir, filepath.FromSlash(m.Path))
+		if _, err := os.Stat(m.Path); err != nil {
+			continue
+		}
+
+		chat.Media = append(chat.Media, m)
+	}
+
+	return chat, nil
+}
+
+// exportDate returns the date of an exported message
+func exportDate(msg exportedMessage) time.Time {
+	if unix, err := strconv.ParseInt(msg.DateUnixtime, 10, 64); err == nil {
+		return time.Unix(unix, 0)
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", msg.Date, time.Local); err == nil {
+		return t
+	}
+	return time.Now()
+}
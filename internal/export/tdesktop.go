@@ -0,0 +1,116 @@
+package export
+
+import (
+	"unicode/utf16"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+)
+
+// Chat is the result.json layout of a Telegram Desktop single chat export
+type Chat struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	ID       int64     `json:"id"`
+	Messages []Message `json:"messages"`
+}
+
+// Message is a message in a Telegram Desktop export
+type Message struct {
+	ID               int          `json:"id"`
+	Type             string       `json:"type"`
+	Date             string       `json:"date"`
+	DateUnixtime     string       `json:"date_unixtime"`
+	From             string       `json:"from,omitempty"`
+	FromID           string       `json:"from_id,omitempty"`
+	ForwardedFrom    string       `json:"forwarded_from,omitempty"`
+	ReplyToMessageID int          `json:"reply_to_message_id,omitempty"`
+	Photo            string       `json:"photo,omitempty"`
+	File             string       `json:"file,omitempty"`
+	MediaType        string       `json:"media_type,omitempty"`
+	MimeType         string       `json:"mime_type,omitempty"`
+	DurationSeconds  int          `json:"duration_seconds,omitempty"`
+	Width            int          `json:"width,omitempty"`
+	Height           int          `json:"height,omitempty"`
+	Performer        string       `json:"performer,omitempty"`
+	Title            string       `json:"title,omitempty"`
+	Text             string       `json:"text"`
+	TextEntities     []TextEntity `json:"text_entities"`
+}
+
+// TextEntity is a piece of formatted message text
+type TextEntity struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Href   string `json:"href,omitempty"`
+	UserID int64  `json:"user_id,omitempty"`
+}
+
+// Directories and media types used by Telegram Desktop for each kind of media
+var mediaLayout = map[string]struct{ Dir, MediaType string }{
+	"photo":    {"photos", ""},
+	"video":    {"video_files", "video_file"},
+	"round":    {"round_video_messages", "video_message"},
+	"voice":    {"voice_messages", "voice_message"},
+	"audio":    {"files", "audio_file"},
+	"document": {"files", ""},
+}
+
+// entityTypes maps Telegram API entity names to export entity names
+var entityTypes = map[string]string{
+	"Bold":        "bold",
+	"Italic":      "italic",
+	"Underline":   "underline",
+	"Strike":      "strikethrough",
+	"Code":        "code",
+	"Pre":         "pre",
+	"TextUrl":     "text_link",
+	"Url":         "link",
+	"Mention":     "mention",
+	"MentionName": "mention_name",
+	"Hashtag":     "hashtag",
+	"Cashtag":     "cashtag",
+	"BotCommand":  "bot_command",
+	"Email":       "email",
+	"Phone":       "phone",
+	"BankCard":    "bank_card",
+	"Spoiler":     "spoiler",
+	"Blockquote":  "blockquote",
+	"CustomEmoji": "custom_emoji",
+}
+
+// textEntities splits the text into export entities.
+// Telegram entity offsets count UTF-16 code units.
+func textEntities(text string, entities []archive.Entity) []TextEntity {
+	units := utf16.Encode([]rune(text))
+	result := []TextEntity{}
+	plain := func(from, to int) {
+		if from < to {
+			result = append(result, TextEntity{Type: "plain", Text: string(utf16.Decode(units[from:to]))})
+		}
+	}
+
+	pos := 0
+	for _, e := range entities {
+		start, end := e.Offset, e.Offset+e.Length
+		// Nested or invalid entities are kept as plain text
+		if start < pos || end > len(units) {
+			continue
+		}
+		plain(pos, start)
+
+		entityType, ok := entityTypes[e.Type]
+		if !ok {
+			entityType = "unknown"
+		}
+		result = append(result, TextEntity{
+			Type:   entityType,
+			Text:   string(utf16.Decode(units[start:end])),
+			Href:   e.URL,
+			UserID: e.UserID,
+		})
+		pos = end
+	}
+	plain(pos, len(units))
+
+	return result
+}
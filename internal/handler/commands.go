@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gotd/td/tg"
+)
+
+// isCommand reports whether a message is a command the account sent to its Saved Messages
+func (h *MessageHandler) isCommand(msg *tg.Message) bool {
+	if h.SelfID == 0 || !msg.Out || !strings.HasPrefix(msg.Message, "/") {
+		return false
+	}
+	user, ok := msg.GetPeerID().(*tg.PeerUser)
+	return ok && user.UserID == h.SelfID
+}
+
+// handleCommand runs a command and replies in Saved Messages
+func (h *MessageHandler) handleCommand(ctx context.Context, msg *tg.Message) error {
+	command := strings.Fields(msg.Message)[0]
+
+	var reply string
+	switch command {
+	case "/quota":
+		reply = h.quotaReport()
+	default:
+		return nil
+	}
+
+	if _, err := h.Sender.Self().Text(ctx, reply); err != nil {
+		return fmt.Errorf("reply to %s: %w", command, err)
+	}
+	return nil
+}
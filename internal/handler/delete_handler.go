@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/processor"
+)
+
+// Actions taken on archived objects when their message is deleted
+const (
+	DeleteModeTag    = config.DeleteModeTag
+	DeleteModeTrash  = config.DeleteModeTrash
+	DeleteModeDelete = config.DeleteModeDelete
+	DeleteModeNone   = config.DeleteModeNone
+)
+
+// TrashPrefix is the bucket prefix deleted objects are moved to in trash mode
+const TrashPrefix = "trash"
+
+// DeletionEvent is an entry of the deletion audit trail
+type DeletionEvent struct {
+	Time      time.Time `json:"time"`
+	ChannelID int64     `json:"channel_id,omitempty"`
+	MessageID int       `json:"message_id"`
+	PeerID    int64     `json:"peer_id"`
+	Username  string    `json:"username"`
+	Key       string    `json:"key"`
+	Action    string    `json:"action"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HandleDeleteMessages processes deleted private and group messages
+func (h *MessageHandler) HandleDeleteMessages(ctx context.Context, e tg.Entities, u *tg.UpdateDeleteMessages) error {
+	return h.handleDelete(ctx, 0, u.Messages)
+}
+
+// HandleDeleteChannelMessages processes deleted channel messages
+func (h *MessageHandler) HandleDeleteChannelMessages(ctx context.Context, e tg.Entities, u *tg.UpdateDeleteChannelMessages) error {
+	return h.handleDelete(ctx, u.ChannelID, u.Messages)
+}
+
+// handleDelete applies the configured delete mode to the archived media of
+// deleted messages and records each deletion in the audit trail.
+// Messages that were never archived are ignored.
+func (h *MessageHandler) handleDelete(ctx context.Context, channelID int64, messageIDs []int) error {
+	now := time.Now().UTC()
+	for _, id := range messageIDs {
+		entries, err := h.Index.MessageEntries(index.MessageRef{ChannelID: channelID, MessageID: id})
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.DeletedAt != nil {
+				continue
+			}
+
+			event := DeletionEvent{
+				Time:      now,
+				ChannelID: channelID,
+				MessageID: id,
+				PeerID:    entry.PeerID,
+				Username:  entry.Username,
+				Key:       entry.Key,
+				Action:    h.Config.DeleteMode,
+			}
+			key, err := h.applyDelete(ctx, entry.Key, now)
+
+			// Trashed objects are looked up under their new key
+			if key != entry.Key {
+				if err := h.Index.MoveEntry(entry.Key, key); err != nil {
+					fmt.Printf("Error indexing move of %s: %v\n", entry.Key, err)
+				}
+			}
+
+			if err != nil {
+				event.Error = err.Error()
+				fmt.Printf("Error handling deletion of %s: %v\n", entry.Key, err)
+			} else {
+				if err := h.Index.MarkDeleted(key, now); err != nil {
+					fmt.Printf("Error indexing deletion of %s: %v\n", entry.Key, err)
+				}
+				// Removed objects no longer count towards the quota
+				if h.Config.DeleteMode == DeleteModeDelete && h.Quota != nil {
+					h.Quota.Add(entry.PeerID, -entry.Size, h.quotaLimits(entry.PeerID, entry.Username))
+				}
+			}
+
+			fmt.Printf("Message %d from %s deleted, %s: %s\n", id, entry.Username, event.Action, entry.Key)
+			if err := h.Archive.AppendObject(ctx, auditObjectName(now), event); err != nil {
+				fmt.Printf("Error writing audit trail: %v\n", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyDelete tags, moves or removes an object with its sidecar and previews,
+// and returns the key the object is stored under afterwards
+func (h *MessageHandler) applyDelete(ctx context.Context, objectName string, at time.Time) (string, error) {
+	switch h.Config.DeleteMode {
+	case DeleteModeTag:
+		return objectName, h.Storage.AddTags(ctx, objectName, map[string]string{
+			"deleted":    "true",
+			"deleted-at": at.Format(time.RFC3339),
+		})
+	case DeleteModeTrash:
+		trashed := path.Join(TrashPrefix, objectName)
+		if err := h.Storage.MoveFile(ctx, objectName, trashed); err != nil {
+			return objectName, err
+		}
+		related, err := h.relatedObjects(ctx, objectName)
+		if err != nil {
+			return trashed, err
+		}
+		for _, key := range related {
+			if err := h.Storage.MoveFile(ctx, key, path.Join(TrashPrefix, key)); err != nil {
+				return trashed, err
+			}
+		}
+		return trashed, nil
+	case DeleteModeDelete:
+		if err := h.Storage.DeleteFile(ctx, objectName); err != nil {
+			return objectName, err
+		}
+		related, err := h.relatedObjects(ctx, objectName)
+		if err != nil {
+			return objectName, err
+		}
+		for _, key := range related {
+			if err := h.Storage.DeleteFile(ctx, key); err != nil {
+				return objectName, err
+			}
+		}
+		return objectName, nil
+	}
+	return objectName, nil
+}
+
+// relatedObjects returns the sidecar and previews stored for an object
+func (h *MessageHandler) relatedObjects(ctx context.Context, objectName string) ([]string, error) {
+	previews, err := processor.ListPreviews(ctx, h.Storage, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("list previews: %w", err)
+	}
+	return append([]string{archive.SidecarKey(objectName)}, previews...), nil
+}
+
+// auditObjectName returns the object name of the audit trail for a day
+func auditObjectName(day time.Time) string {
+	return fmt.Sprintf("audit/deletions/%s.jsonl", day.UTC().Format(time.DateOnly))
+}
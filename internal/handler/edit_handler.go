@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/media"
+)
+
+// HandleEditMessage processes edited private and group messages
+func (h *MessageHandler) HandleEditMessage(ctx context.Context, e tg.Entities, u *tg.UpdateEditMessage) error {
+	return h.handleEdit(ctx, e, u.Message)
+}
+
+// HandleEditChannelMessage processes edited channel messages
+func (h *MessageHandler) HandleEditChannelMessage(ctx context.Context, e tg.Entities, u *tg.UpdateEditChannelMessage) error {
+	return h.handleEdit(ctx, e, u.Message)
+}
+
+// handleEdit archives replaced media as a new version and
+// updates the sidecar when only the caption changed
+func (h *MessageHandler) handleEdit(ctx context.Context, e tg.Entities, m tg.MessageClass) error {
+	msg, ok := m.(*tg.Message)
+	if !ok {
+		return nil
+	}
+
+	// Find peer information and check if it is a target
+	peer, isTarget, err := h.findTarget(ctx, msg)
+	if err != nil || !isTarget {
+		return err
+	}
+
+	fmt.Printf("Message %d from %s edited: %s\n", msg.ID, peer, msg.Message)
+
+	// An edit arriving while the message is still being archived is applied
+	// once that is done, so it sees the indexed entry
+	h.sequence(ctx, peer.messageRef(msg.ID), func(done func()) {
+		if err := h.applyEdit(ctx, e, msg, peer, done); err != nil {
+			fmt.Printf("Error applying edit of message %d from %s: %v\n", msg.ID, peer, err)
+		}
+	})
+	return nil
+}
+
+// applyEdit archives an edit against the indexed state of the message and
+// calls done once it is archived
+func (h *MessageHandler) applyEdit(ctx context.Context, e tg.Entities, msg *tg.Message, peer chatPeer, done func()) error {
+	prev, found, err := h.Index.GetMessage(peer.messageRef(msg.ID))
+	if err != nil {
+		done()
+		return fmt.Errorf("find archived message: %w", err)
+	}
+
+	// New or replaced media is archived as a new version. Media imported from
+	// an export has no known ID, so its edits only update the caption.
+	mediaID := media.MediaID(msg.Media)
+	if mediaID != 0 && (!found || (prev.MediaID != 0 && prev.MediaID != mediaID)) {
+		version := 1
+		if found {
+			version = max(prev.Version, 1) + 1
+		}
+		h.processMedia(ctx, msg, e, peer, version, done)
+		return nil
+	}
+	defer done()
+
+	// Text-only edits are recorded in the message archive
+	if !found {
+		h.archiveMessage(ctx, msg, e, peer, "")
+		return nil
+	}
+
+	if err := h.updateCaption(ctx, msg, prev.Key); err != nil {
+		return fmt.Errorf("update caption of %s: %w", prev.Key, err)
+	}
+	h.archiveMessage(ctx, msg, e, peer, prev.Key)
+	return nil
+}
+
+// updateCaption rewrites the sidecar of an object with the edited caption
+func (h *MessageHandler) updateCaption(ctx context.Context, msg *tg.Message, objectName string) error {
+	sidecar, err := h.readSidecar(ctx, objectName)
+	if err != nil {
+		// Objects archived before sidecars existed get a new one
+		sidecar = archive.Sidecar{
+			Key:       objectName,
+			MessageID: msg.ID,
+			Date:      time.Unix(int64(msg.Date), 0).UTC(),
+			Version:   1,
+		}
+	}
+
+	sidecar.Caption = msg.Message
+	sidecar.Entities = archive.Entities(msg.Entities)
+	if date := editDate(msg); !date.IsZero() {
+		edited := date.UTC()
+		sidecar.EditDate = &edited
+	}
+
+	return h.writeSidecar(ctx, sidecar)
+}
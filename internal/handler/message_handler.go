@@ -4,14 +4,24 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"slices"
 
 	"github.com/gotd/contrib/storage"
 	"github.com/gotd/td/telegram/message"
 	"github.com/gotd/td/tg"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/cache"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/media"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/processor"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/quota"
 	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/utils"
 )
@@ -19,32 +29,41 @@ import (
 // MessageHandler handles incoming messages
 type MessageHandler struct {
 	Downloader *utils.MediaDownloader
-	Minio      *store.MinioClient
+	Storage    store.Storage
 	PeerDB     storage.PeerStorage
+	Index      *index.Index
+	Archive    *archive.ChatArchive
 	Sender     *message.Sender
 	Config     config.Config
 	UserTarget []string
 	WorkerPool chan struct{}
+	Processors processor.Chain
+	Quota      *quota.Tracker
+	Cache      *cache.MediaCache
+
+	// SelfID is the ID of the account, whose Saved Messages take commands
+	SelfID int64
+
+	// targetIDs holds the peer IDs USER_TARGET entries resolved to at startup
+	targetIDs map[int64]bool
+
+	// pending holds the latest unfinished work on each message, so edits
+	// are applied after the upload they refer to
+	pendingMu sync.Mutex
+	pending   map[index.MessageRef]chan struct{}
 }
 
 // NewMessageHandler creates a new message handler
-func NewMessageHandler(downloader *utils.MediaDownloader, minio *store.MinioClient, peerDB storage.PeerStorage, sender *message.Sender, cfg config.Config) *MessageHandler {
-	workerSize, err := strconv.Atoi(cfg.WORKER_POOL)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse WORKER_POOL: %v\n", err)
-	}
-	if workerSize <= 0 {
-		workerSize = 5
-	}
-
+func NewMessageHandler(downloader *utils.MediaDownloader, backend store.Storage, peerDB storage.PeerStorage, idx *index.Index, sender *message.Sender, cfg config.Config) *MessageHandler {
 	return &MessageHandler{
 		Downloader: downloader,
-		Minio:      minio,
+		Storage:    backend,
 		PeerDB:     peerDB,
+		Index:      idx,
 		UserTarget: cfg.UserTarget,
 		Sender:     sender,
 		Config:     cfg,
-		WorkerPool: make(chan struct{}, workerSize),
+		WorkerPool: make(chan struct{}, cfg.WorkerPoolSize()),
 	}
 }
 
@@ -55,87 +74,295 @@ func (h *MessageHandler) HandleNewMessage(ctx context.Context, e tg.Entities, u
 		return nil
 	}
 
-	// Find peer information
-	p, err := storage.FindPeer(ctx, h.PeerDB, msg.GetPeerID())
-	if err != nil {
-		return fmt.Errorf("find peer: %w", err)
+	// Commands are sent to Saved Messages and never archived
+	if h.isCommand(msg) {
+		return h.handleCommand(ctx, msg)
 	}
 
-	// Check if user is in target list if target list is not empty
-	if len(h.UserTarget) > 0 {
-		isTarget := slices.Contains(h.UserTarget, p.User.Username)
-		if !isTarget {
-			return nil
-		}
+	// Find peer information and check if it is a target
+	peer, isTarget, err := h.findTarget(ctx, msg)
+	if err != nil || !isTarget {
+		return err
 	}
 
 	// Print message with formatted output
-	fmt.Printf("Message from %s: %s\n", p.User.Username, msg.Message)
+	fmt.Printf("Message from %s: %s\n", peer, msg.Message)
+
+	// Archive text-only messages right away
+	if msg.Media == nil {
+		h.archiveMessage(ctx, msg, e, peer, "")
+	}
 
-	// Process media if present
+	// Process media if present; later edits of the message wait for it
 	if msg.Media != nil {
-		// Acquire a worker from the pool
-		h.WorkerPool <- struct{}{}
-
-		// Process media concurrently
-		go func() {
-			defer func() {
-				// Release the worker back to the pool
-				<-h.WorkerPool
-			}()
-
-			err := h.handleMedia(ctx, msg.Media, p.User.Username)
-			if err != nil {
-				fmt.Printf("Error processing media from %s: %v\n", p.User.Username, err)
-			}
-		}()
+		h.sequence(ctx, peer.messageRef(msg.ID), func(done func()) {
+			h.processMedia(ctx, msg, e, peer, 1, done)
+		})
 	}
 
 	return nil
 }
 
-// handleMedia processes media in messages
-func (h *MessageHandler) handleMedia(ctx context.Context, media tg.MessageMediaClass, username string) error {
-	fmt.Printf("Message contains media from %s\n", username)
-	// Download the media
-	path, ext, err := h.Downloader.DownloadMedia(ctx, media, username)
-	if err != nil {
-		return fmt.Errorf("download media: %w", err)
+// chatPeer identifies the chat a message belongs to
+type chatPeer struct {
+	ID       int64
+	Username string
+	Name     string
+	Phone    string
+	Channel  bool
+}
+
+// messageRef returns the index reference of a message in the chat
+func (p chatPeer) messageRef(messageID int) index.MessageRef {
+	ref := index.MessageRef{MessageID: messageID}
+	if p.Channel {
+		ref.ChannelID = p.ID
 	}
+	return ref
+}
 
-	// Get file info for upload
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		return fmt.Errorf("get file info: %w", err)
+// peerOf returns the chat identity of a stored peer
+func peerOf(p storage.Peer) chatPeer {
+	id, username, name, phone := store.PeerNames(p)
+	return chatPeer{
+		ID:       id,
+		Username: username,
+		Name:     name,
+		Phone:    phone,
+		Channel:  p.Channel != nil,
+	}
+}
+
+// String returns the username of the chat, or its ID if it has none
+func (p chatPeer) String() string {
+	if p.Username != "" {
+		return p.Username
+	}
+	return strconv.FormatInt(p.ID, 10)
+}
+
+// matches reports whether a USER_TARGET entry refers to the chat by ID,
+// username or phone number
+func (p chatPeer) matches(target string) bool {
+	switch {
+	case target == "":
+		return false
+	case target == strconv.FormatInt(p.ID, 10):
+		return true
+	case strings.HasPrefix(target, "+"):
+		return p.Phone != "" && index.NormalizePhone(target) == p.Phone
+	}
+	return p.Username != "" && strings.EqualFold(strings.TrimPrefix(target, "@"), p.Username)
+}
+
+// findTarget resolves the chat of a message and reports whether it is a target
+// and its direction is archived
+func (h *MessageHandler) findTarget(ctx context.Context, msg *tg.Message) (chatPeer, bool, error) {
+	if !h.archivesDirection(msg.Out) {
+		return chatPeer{}, false, nil
 	}
 
-	// Open the file for reading
-	file, err := os.Open(path)
+	p, err := storage.FindPeer(ctx, h.PeerDB, msg.GetPeerID())
 	if err != nil {
-		return fmt.Errorf("open file: %w", err)
+		return chatPeer{}, false, fmt.Errorf("find peer: %w", err)
+	}
+	peer := peerOf(p)
+
+	// Check if user is in target list if target list is not empty
+	if len(h.UserTarget) > 0 && !h.targetIDs[peer.ID] && !slices.ContainsFunc(h.UserTarget, peer.matches) {
+		return peer, false, nil
+	}
+	return peer, true, nil
+}
+
+// archivesDirection reports whether messages in the given direction are archived
+func (h *MessageHandler) archivesDirection(out bool) bool {
+	switch h.Config.MessageDirection {
+	case config.DirectionIncoming:
+		return !out
+	case config.DirectionOutgoing:
+		return out
+	}
+	return true
+}
+
+// track registers work on a message. It returns a channel that is closed once
+// earlier work on the message is done, or nil when there is none, and a
+// function to call when the new work is done.
+func (h *MessageHandler) track(ref index.MessageRef) (<-chan struct{}, func()) {
+	h.pendingMu.Lock()
+	defer h.pendingMu.Unlock()
+
+	if h.pending == nil {
+		h.pending = map[index.MessageRef]chan struct{}{}
+	}
+	prev := h.pending[ref]
+	done := make(chan struct{})
+	h.pending[ref] = done
+
+	return prev, func() {
+		close(done)
+		h.pendingMu.Lock()
+		if h.pending[ref] == done {
+			delete(h.pending, ref)
+		}
+		h.pendingMu.Unlock()
+	}
+}
+
+// sequence runs fn once earlier work on a message is done: right away when
+// there is none, otherwise in the background. fn calls done when its work,
+// including work it hands off, is finished.
+func (h *MessageHandler) sequence(ctx context.Context, ref index.MessageRef, fn func(done func())) {
+	wait, done := h.track(ref)
+	if wait == nil {
+		fn(done)
+		return
+	}
+	go func() {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			done()
+			return
+		}
+		fn(done)
+	}()
+}
+
+// runOnPool runs work concurrently once a worker of the pool is free and calls
+// done after it
+func (h *MessageHandler) runOnPool(done func(), work func()) {
+	// Acquire a worker from the pool
+	h.WorkerPool <- struct{}{}
+
+	go func() {
+		defer func() {
+			// Release the worker back to the pool
+			<-h.WorkerPool
+		}()
+		defer done()
+		work()
+	}()
+}
+
+// processMedia downloads and archives message media on the worker pool
+func (h *MessageHandler) processMedia(ctx context.Context, msg *tg.Message, e tg.Entities, peer chatPeer, version int, done func()) {
+	h.runOnPool(done, func() {
+		objectName, err := h.handleMedia(ctx, msg, peer, version)
+		if err != nil {
+			fmt.Printf("Error processing media from %s: %v\n", peer, err)
+		}
+
+		// Archive the message along with the key of its media
+		h.archiveMessage(ctx, msg, e, peer, objectName)
+	})
+}
+
+// handleMedia processes media in messages and returns the object name of the upload
+func (h *MessageHandler) handleMedia(ctx context.Context, msg *tg.Message, peer chatPeer, version int) (string, error) {
+	fmt.Printf("Message contains media from %s\n", peer)
+
+	// Do not download media that would be skipped anyway
+	if h.Config.Quota.HardAction != config.QuotaRoute {
+		limits := h.quotaLimits(peer.ID, peer.Username)
+		if _, err := h.reserveQuota(ctx, peer.ID, peer.Username, limits, 0); err != nil {
+			return "", err
+		}
+	}
+
+	// Wait for disk space before downloading
+	if h.Cache != nil {
+		if err := h.Cache.WaitForSpace(ctx); err != nil {
+			return "", fmt.Errorf("wait for disk space: %w", err)
+		}
 	}
-	defer file.Close()
 
-	// Upload to MinIO
-	objectName := fmt.Sprintf("%s/%s/%s", username, ext, fileInfo.Name())
-	url, err := h.Minio.UploadFile(ctx, objectName, file, fileInfo.Size(), ext)
+	// Download the media into the chat's directory
+	path, ext, err := h.Downloader.DownloadMedia(ctx, msg.Media, strconv.FormatInt(peer.ID, 10))
 	if err != nil {
-		return fmt.Errorf("upload file: %w", err)
+		return "", fmt.Errorf("download media: %w", err)
 	}
 
-	fmt.Printf("File uploaded to %s\n", url)
+	// Upload the file along with the message details
+	objectName, url, err := h.ArchiveFile(ctx, MediaFile{
+		Path:      path,
+		Kind:      ext,
+		Attrs:     media.AttributesFromMedia(msg.Media),
+		MediaID:   media.MediaID(msg.Media),
+		MessageID: msg.ID,
+		Date:      time.Unix(int64(msg.Date), 0),
+		EditDate:  editDate(msg),
+		Caption:   msg.Message,
+		Entities:  archive.Entities(msg.Entities),
+		PeerID:    peer.ID,
+		Channel:   peer.Channel,
+		Username:  peer.Username,
+		Out:       msg.Out,
+		Version:   version,
+	})
+	if err != nil {
+		if h.Cache != nil {
+			h.Cache.Release(path)
+		}
+		return "", err
+	}
 
-	// Delete the file if configured
-	if h.Config.AUTO_REMOVE_MEDIA {
+	// Keep the file in the cache once it is uploaded, or delete it if configured
+	switch {
+	case h.Cache != nil && url != "":
+		h.Cache.Archived(path)
+	case h.Cache != nil:
+		h.Cache.Release(path)
+	case h.Config.AUTO_REMOVE_MEDIA:
 		if err := os.Remove(path); err != nil {
-			return fmt.Errorf("remove file: %w", err)
+			return objectName, fmt.Errorf("remove file: %w", err)
 		}
 	}
 
+	// Without a link the file was spooled until storage is back
+	if url == "" {
+		if h.Config.SEND_INFO_UPLOADED {
+			h.Sender.Self().Text(ctx, fmt.Sprintf("Storage is unavailable, %s is queued for upload", objectName))
+		}
+		fmt.Printf("File %s queued for upload\n", filepath.Base(path))
+		return objectName, nil
+	}
+
 	if h.Config.SEND_INFO_UPLOADED {
-		h.Sender.Self().Text(ctx, fmt.Sprintf("File uploaded to %s", url))
+		h.Sender.Self().Text(ctx, uploadedText(h.Config, objectName, url))
 	}
 
-	fmt.Printf("File %s uploaded to %s\n", fileInfo.Name(), url)
-	return nil
+	fmt.Printf("File %s uploaded to %s\n", filepath.Base(path), url)
+	return objectName, nil
+}
+
+// uploadedText describes an upload. Links to encrypted files cannot be opened
+// directly, so the download command is named instead.
+func uploadedText(cfg config.Config, objectName, url string) string {
+	if cfg.Encryption == "" || cfg.Encryption == config.EncryptionNone {
+		return fmt.Sprintf("File uploaded to %s", url)
+	}
+	return fmt.Sprintf("File uploaded as %s. It is encrypted, fetch it with: teleminio-uploader download -key %s", objectName, objectName)
+}
+
+// archiveMessage appends the message to the chat archive when message archiving is enabled
+func (h *MessageHandler) archiveMessage(ctx context.Context, msg *tg.Message, e tg.Entities, peer chatPeer, objectName string) {
+	if !h.Config.ArchiveMessages {
+		return
+	}
+
+	record := archive.NewRecord(msg, e, peer.ID, peer.Username, h.SelfID)
+	record.MediaKey = objectName
+	if err := h.Archive.Append(ctx, record); err != nil {
+		fmt.Printf("Error archiving message from %s: %v\n", peer, err)
+	}
+}
+
+// editDate returns the time a message was last edited, or zero if it never was
+func editDate(msg *tg.Message) time.Time {
+	if date, ok := msg.GetEditDate(); ok {
+		return time.Unix(int64(date), 0)
+	}
+	return time.Time{}
 }
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+)
+
+// TestSequenceOrder runs an upload and two media-replacing edits of the same
+// message on a pool with a single worker, like edits arriving while the
+// original upload is still running
+func TestSequenceOrder(t *testing.T) {
+	h := &MessageHandler{WorkerPool: make(chan struct{}, 1)}
+	ctx := context.Background()
+	ref := index.MessageRef{MessageID: 1}
+
+	release := make(chan struct{})
+	order := make(chan string, 3)
+	h.sequence(ctx, ref, func(done func()) {
+		h.runOnPool(done, func() {
+			<-release
+			order <- "upload"
+		})
+	})
+	for _, name := range []string{"edit 1", "edit 2"} {
+		h.sequence(ctx, ref, func(done func()) {
+			h.runOnPool(done, func() { order <- name })
+		})
+	}
+	close(release)
+
+	for _, want := range []string{"upload", "edit 1", "edit 2"} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("ran %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q did not run", want)
+		}
+	}
+}
+
+// TestSequenceCanceled makes sure waiting work gives up on shutdown without
+// holding back later work
+func TestSequenceCanceled(t *testing.T) {
+	h := &MessageHandler{WorkerPool: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	ref := index.MessageRef{MessageID: 1}
+
+	var first func()
+	h.sequence(ctx, ref, func(done func()) { first = done })
+
+	ran := make(chan struct{})
+	h.sequence(ctx, ref, func(done func()) {
+		defer done()
+		close(ran)
+	})
+	cancel()
+
+	finished := make(chan struct{})
+	h.sequence(context.Background(), ref, func(done func()) {
+		defer done()
+		close(finished)
+	})
+	defer first()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("work after a canceled edit did not run")
+	}
+	select {
+	case <-ran:
+		t.Error("canceled work ran")
+	default:
+	}
+}
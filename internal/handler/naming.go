@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// DefaultKeyTemplate is the object key layout used when none is configured
+const DefaultKeyTemplate = "{peer_id}/{kind}/{filename}"
+
+// SplitKeyTemplate is the default layout when sent and received media are split
+const SplitKeyTemplate = "{peer_id}/{direction}/{kind}/{filename}"
+
+// Message directions as used in object names
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
+// KeyFields holds the values available to the object key template
+type KeyFields struct {
+	PeerID      int64
+	Username    string
+	Kind        string
+	Filename    string
+	Direction   string
+	Date        time.Time
+	CaptureTime time.Time
+}
+
+// RenderKey renders an object key template.
+// Capture placeholders fall back to the message date when the capture time is unknown.
+func RenderKey(template string, f KeyFields) string {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+
+	capture := f.CaptureTime
+	if capture.IsZero() {
+		capture = f.Date
+	}
+
+	r := strings.NewReplacer(
+		"{peer_id}", strconv.FormatInt(f.PeerID, 10),
+		"{username}", f.Username,
+		"{kind}", f.Kind,
+		"{filename}", f.Filename,
+		"{direction}", f.Direction,
+		"{date}", f.Date.Format("2006-01-02"),
+		"{year}", f.Date.Format("2006"),
+		"{month}", f.Date.Format("01"),
+		"{capture_date}", capture.Format("2006-01-02"),
+		"{capture_year}", capture.Format("2006"),
+		"{capture_month}", capture.Format("01"),
+	)
+
+	// Clean the result so empty placeholders do not leave double slashes
+	return strings.TrimPrefix(path.Clean(r.Replace(template)), "/")
+}
+
+// KeyTemplate returns the object key template media are uploaded with
+func KeyTemplate(cfg config.Config) string {
+	if cfg.ObjectKeyTemplate != "" {
+		return cfg.ObjectKeyTemplate
+	}
+	if cfg.MessageDirection == config.DirectionSplit {
+		return SplitKeyTemplate
+	}
+	return DefaultKeyTemplate
+}
+
+// KeyPrefix renders the fixed start of the keys a template produces for a peer,
+// up to the last slash before the first placeholder other than {peer_id} and
+// {username}. It is empty when the template does not start with a fixed part.
+func KeyPrefix(template string, f KeyFields) string {
+	if template == "" {
+		template = DefaultKeyTemplate
+	}
+
+	r := strings.NewReplacer(
+		"{peer_id}", strconv.FormatInt(f.PeerID, 10),
+		"{username}", f.Username,
+	)
+	rendered := r.Replace(template)
+	if i := strings.Index(rendered, "{"); i >= 0 {
+		rendered = rendered[:i]
+	}
+	i := strings.LastIndex(rendered, "/")
+	if i < 0 {
+		return ""
+	}
+	prefix := strings.TrimPrefix(path.Clean(rendered[:i]), "/")
+	if prefix == "" || prefix == "." {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// usesCaptureTime reports whether a key template contains a capture placeholder
+func usesCaptureTime(template string) bool {
+	return strings.Contains(template, "{capture_")
+}
+
+// VersionedKey adds a version suffix to an object name for replaced media.
+// The first version keeps the plain name.
+func VersionedKey(objectName string, version int) string {
+	if version <= 1 {
+		return objectName
+	}
+	ext := path.Ext(objectName)
+	return fmt.Sprintf("%s_v%d%s", strings.TrimSuffix(objectName, ext), version, ext)
+}
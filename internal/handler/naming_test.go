@@ -0,0 +1,27 @@
+package handler
+
+import "testing"
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		template string
+		username string
+		want     string
+	}{
+		{"", "", "42/"},
+		{DefaultKeyTemplate, "", "42/"},
+		{SplitKeyTemplate, "", "42/"},
+		{"media/{peer_id}/{year}/{filename}", "", "media/42/"},
+		{"{username}/{peer_id}/{kind}/{filename}", "alice", "alice/42/"},
+		{"{username}/{peer_id}/{kind}/{filename}", "", "42/"},
+		{"{kind}/{peer_id}/{filename}", "", ""},
+		{"archive/{date}-{peer_id}/{filename}", "", "archive/"},
+		{"{peer_id}-{kind}/{filename}", "", ""},
+	}
+	for _, tt := range tests {
+		got := KeyPrefix(tt.template, KeyFields{PeerID: 42, Username: tt.username})
+		if got != tt.want {
+			t.Errorf("KeyPrefix(%q, %q) = %q, want %q", tt.template, tt.username, got, tt.want)
+		}
+	}
+}
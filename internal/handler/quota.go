@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/quota"
+)
+
+// ErrQuotaExceeded is returned for uploads skipped because of a hard quota
+var ErrQuotaExceeded = errors.New("hard quota exceeded")
+
+// hasQuota reports whether any quota is configured
+func (h *MessageHandler) hasQuota() bool {
+	q := h.Config.Quota
+	return h.Quota != nil && (q.Default.Soft > 0 || q.Default.Hard > 0 || len(q.Peers) > 0)
+}
+
+// quotaLimits returns the quota of a peer, preferring a QUOTA_PEERS entry
+// that refers to it over the default
+func (h *MessageHandler) quotaLimits(peerID int64, username string) config.Quota {
+	if len(h.Config.Quota.Peers) == 0 {
+		return h.Config.Quota.Default
+	}
+
+	peer := chatPeer{ID: peerID, Username: username}
+	if alias, ok, err := h.Index.GetAlias(peerID); err == nil && ok {
+		peer.Phone = alias.Phone
+		if peer.Username == "" {
+			peer.Username = alias.Username()
+		}
+	}
+	saved, err := h.Index.Targets()
+	if err != nil {
+		fmt.Printf("Error loading saved targets: %v\n", err)
+	}
+
+	for _, q := range h.Config.Quota.Peers {
+		if peer.matches(q.Target) || (saved != nil && saved[q.Target] == peerID) {
+			return q.Quota
+		}
+	}
+	return h.Config.Quota.Default
+}
+
+// reserveQuota decides what happens to an upload of the given size for a peer
+// and counts the size towards the peer's usage right away. It returns the
+// prefix to route the upload to, or ErrQuotaExceeded when it has to be skipped.
+// A size of 0 only checks the quota. Failed uploads give the size back with
+// releaseQuota.
+func (h *MessageHandler) reserveQuota(ctx context.Context, peerID int64, username string, limits config.Quota, size int64) (string, error) {
+	if h.Quota == nil {
+		return "", nil
+	}
+
+	usage, ok := h.Quota.Reserve(peerID, size, limits)
+	if ok {
+		return "", nil
+	}
+
+	route := h.Config.Quota.HardAction == config.QuotaRoute
+	if h.Quota.Raise(peerID, quota.Hard) {
+		action := "new uploads are skipped"
+		if route {
+			action = fmt.Sprintf("new uploads go to %s/", h.Config.Quota.RoutePrefix)
+		}
+		h.notify(ctx, fmt.Sprintf("Storage quota exceeded: %s uses %s of its %s hard quota, %s",
+			quotaPeerName(peerID, username), quota.FormatBytes(usage), quota.FormatBytes(limits.Hard), action))
+	}
+
+	if route {
+		// Routed uploads are stored as well and still count
+		h.Quota.Add(peerID, size, limits)
+		return h.Config.Quota.RoutePrefix, nil
+	}
+	return "", ErrQuotaExceeded
+}
+
+// releaseQuota gives back the size reserved for an upload that failed
+func (h *MessageHandler) releaseQuota(peerID int64, limits config.Quota, size int64) {
+	if h.Quota != nil {
+		h.Quota.Add(peerID, -size, limits)
+	}
+}
+
+// alertUsage sends an alert when an upload brought the peer to its soft or
+// hard quota
+func (h *MessageHandler) alertUsage(ctx context.Context, peerID int64, username string, limits config.Quota) {
+	if h.Quota == nil {
+		return
+	}
+
+	usage := h.Quota.Usage(peerID)
+	level := quota.LevelOf(usage, limits)
+	if !h.Quota.Raise(peerID, level) {
+		return
+	}
+	switch level {
+	case quota.Soft:
+		h.notify(ctx, fmt.Sprintf("Storage quota warning: %s uses %s of its %s soft quota",
+			quotaPeerName(peerID, username), quota.FormatBytes(usage), quota.FormatBytes(limits.Soft)))
+	case quota.Hard:
+		h.notify(ctx, fmt.Sprintf("Storage quota reached: %s uses %s of its %s hard quota",
+			quotaPeerName(peerID, username), quota.FormatBytes(usage), quota.FormatBytes(limits.Hard)))
+	}
+}
+
+// quotaPeerName names a peer in quota messages
+func quotaPeerName(peerID int64, username string) string {
+	if username != "" {
+		return fmt.Sprintf("@%s (%d)", username, peerID)
+	}
+	return fmt.Sprintf("%d", peerID)
+}
+
+// notify sends a message to Saved Messages, or prints it when running without a client
+func (h *MessageHandler) notify(ctx context.Context, text string) {
+	fmt.Println(text)
+	if h.Sender == nil {
+		return
+	}
+	if _, err := h.Sender.Self().Text(ctx, text); err != nil {
+		fmt.Printf("Error sending notification: %v\n", err)
+	}
+}
+
+// quotaReport lists the storage used by every peer along with its quota
+func (h *MessageHandler) quotaReport() string {
+	if h.Quota == nil {
+		return "Quota tracking is not enabled"
+	}
+
+	usage := h.Quota.All()
+	ids := make([]int64, 0, len(usage))
+	for id := range usage {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return usage[ids[i]] > usage[ids[j]] })
+
+	var b strings.Builder
+	var total int64
+	b.WriteString("Storage usage per peer:\n")
+	for _, id := range ids {
+		username := ""
+		if alias, ok, err := h.Index.GetAlias(id); err == nil && ok {
+			username = alias.Username()
+		}
+		limits := h.quotaLimits(id, username)
+		total += usage[id]
+
+		fmt.Fprintf(&b, "%s: %s", quotaPeerName(id, username), quota.FormatBytes(usage[id]))
+		if limits.Soft > 0 {
+			fmt.Fprintf(&b, ", soft %s", quota.FormatBytes(limits.Soft))
+		}
+		if limits.Hard > 0 {
+			fmt.Fprintf(&b, ", hard %s", quota.FormatBytes(limits.Hard))
+		}
+		if level := quota.LevelOf(usage[id], limits); level != quota.Normal {
+			fmt.Fprintf(&b, " [%s quota reached]", level)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Total: %s", quota.FormatBytes(total))
+
+	return b.String()
+}
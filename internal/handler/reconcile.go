@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/media"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/utils"
+)
+
+// ReconcileOptions controls what Reconcile changes
+type ReconcileOptions struct {
+	// DryRun only reports what would be done
+	DryRun bool
+	// Keep leaves archived files in the media directory
+	Keep bool
+	// Before skips files modified after it, which a running bot may still be
+	// downloading or uploading. The zero time reconciles every file.
+	Before time.Time
+}
+
+// ReconcileReport counts what Reconcile found
+type ReconcileReport struct {
+	Archived   int
+	Uploaded   int
+	Deleted    int
+	Partial    int
+	Skipped    int
+	Unresolved int
+	Failed     int
+}
+
+// reconcileResult is what reconcileFile did with a local file
+type reconcileResult int
+
+const (
+	reconcileUploaded reconcileResult = iota
+	reconcileArchived
+	reconcileDeleted
+)
+
+// Reconcile walks the media directory (<peer_id>/<kind>/<file>, or
+// <username>/<ext>/<file> from older versions), uploads files missing from the
+// bucket or stored with a different size or hash, removes files that are
+// safely archived or belong to deleted messages and deletes partial downloads
+func (h *MessageHandler) Reconcile(ctx context.Context, mediaDir string, opts ReconcileOptions) (ReconcileReport, error) {
+	var report ReconcileReport
+	entries := map[int64][]index.Entry{}
+	peers := map[string]int64{}
+
+	err := filepath.WalkDir(mediaDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && filePath == mediaDir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		// Recent files may belong to a bot that is running
+		if !opts.Before.IsZero() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.ModTime().After(opts.Before) {
+				report.Skipped++
+				return nil
+			}
+		}
+
+		// Leftovers of interrupted downloads are never complete
+		if strings.HasSuffix(d.Name(), utils.PartSuffix) {
+			report.Partial++
+			fmt.Printf("Removing partial download %s\n", filePath)
+			if !opts.DryRun {
+				if err := os.Remove(filePath); err != nil {
+					fmt.Printf("Error removing %s: %v\n", filePath, err)
+				}
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(mediaDir, filePath)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			report.Unresolved++
+			fmt.Printf("Skipping %s, it is not in a <peer>/<kind>/<file> directory\n", filePath)
+			return nil
+		}
+		peerID, ok := peers[parts[0]]
+		if !ok {
+			peerID, err = h.resolvePeerDir(parts[0])
+			if err != nil {
+				return err
+			}
+			peers[parts[0]] = peerID
+		}
+		if peerID == 0 {
+			report.Unresolved++
+			fmt.Printf("Skipping %s, no known peer has the ID or username %q\n", filePath, parts[0])
+			return nil
+		}
+
+		// Index entries of the peer are loaded once
+		if _, ok := entries[peerID]; !ok {
+			found, err := h.Index.Query(index.Filter{PeerID: peerID, IncludeDeleted: true})
+			if err != nil {
+				return err
+			}
+			entries[peerID] = found
+		}
+
+		result, err := h.reconcileFile(ctx, filePath, peerID, parts[1], entries[peerID], opts)
+		switch {
+		case err != nil:
+			report.Failed++
+			fmt.Printf("Error reconciling %s: %v\n", filePath, err)
+			return nil
+		case result == reconcileArchived:
+			report.Archived++
+		case result == reconcileDeleted:
+			report.Deleted++
+		default:
+			report.Uploaded++
+		}
+
+		switch {
+		case opts.DryRun:
+		case !opts.Keep:
+			if err := os.Remove(filePath); err != nil {
+				fmt.Printf("Error removing %s: %v\n", filePath, err)
+			}
+		case h.Cache != nil:
+			h.Cache.Archived(filePath)
+		}
+		return nil
+	})
+
+	return report, err
+}
+
+// resolvePeerDir returns the peer of a media directory named after its ID or,
+// in older versions, its username, or 0 when it is unknown
+func (h *MessageHandler) resolvePeerDir(name string) (int64, error) {
+	if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return id, nil
+	}
+	alias, found, err := h.Index.FindAlias(name)
+	if err != nil || !found {
+		return 0, err
+	}
+	return alias.ID, nil
+}
+
+// reconcileFile makes sure a local file is archived, unless its message was
+// deleted, and reports what it did
+func (h *MessageHandler) reconcileFile(ctx context.Context, filePath string, peerID int64, kind string, entries []index.Entry, opts ReconcileOptions) (reconcileResult, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return reconcileUploaded, err
+	}
+
+	entry, found := matchEntry(entries, stat.Name(), stat.Size())
+	if found && entry.DeletedAt != nil {
+		// Uploading it again would bring back media deleted in Telegram
+		fmt.Printf("%s belongs to deleted message %s, not archiving it\n", filePath, entry.Key)
+		return reconcileDeleted, nil
+	}
+	if found {
+		matches, err := h.storedMatches(ctx, entry.Key, filePath, stat.Size())
+		if err != nil {
+			return reconcileUploaded, err
+		}
+		if matches {
+			return reconcileArchived, nil
+		}
+		fmt.Printf("%s is missing or differs from %s, uploading it again\n", entry.Key, filePath)
+	} else {
+		fmt.Printf("%s is not in the index, uploading it\n", filePath)
+	}
+	if opts.DryRun {
+		return reconcileUploaded, nil
+	}
+
+	f := reconcileMediaFile(filePath, peerID, kind, entry, found, h.username(peerID), stat)
+
+	// Keep the caption of the existing sidecar. The upload replaces the
+	// object, so its size is reserved again instead of counting twice.
+	if found {
+		h.releaseQuota(peerID, h.quotaLimits(peerID, entry.Username), entry.Size)
+		if sidecar, err := h.readSidecar(ctx, entry.Key); err == nil {
+			f.Caption = sidecar.Caption
+			f.Entities = sidecar.Entities
+			if sidecar.EditDate != nil {
+				f.EditDate = *sidecar.EditDate
+			}
+		}
+	}
+
+	_, _, err = h.ArchiveFile(ctx, f)
+	return reconcileUploaded, err
+}
+
+// matchEntry finds the index entry of a local file, preferring one with the
+// same size and then the most recent one
+func matchEntry(entries []index.Entry, name string, size int64) (index.Entry, bool) {
+	var best index.Entry
+	var found bool
+	for _, e := range entries {
+		if !strings.HasSuffix(path.Base(e.Key), VersionedKey(name, e.Version)) {
+			continue
+		}
+		switch {
+		case !found,
+			e.Size == size && best.Size != size,
+			(e.Size == size) == (best.Size == size) && e.Date.After(best.Date):
+			best, found = e, true
+		}
+	}
+	return best, found
+}
+
+// storedMatches reports whether an object exists with the size of a local file,
+// and with its SHA-256 when the object's digest covers the original data
+func (h *MessageHandler) storedMatches(ctx context.Context, key, filePath string, size int64) (bool, error) {
+	exists, err := h.Storage.ObjectExists(ctx, key)
+	if err != nil || !exists {
+		return false, err
+	}
+	info, err := h.Storage.GetObjectInfo(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if info.Size != size {
+		return false, nil
+	}
+
+	// Compressed and encrypted objects store a digest of the transformed data
+	sum := info.UserMetadata[store.MetaSHA256]
+	if sum == "" || info.UserMetadata[store.MetaCompression] != "" || info.UserMetadata[store.MetaEncryption] != "" {
+		return true, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == sum, nil
+}
+
+// reconcileMediaFile describes a local file for upload, using the details of
+// its index entry when there is one
+func reconcileMediaFile(filePath string, peerID int64, kind string, entry index.Entry, found bool, username string, stat os.FileInfo) MediaFile {
+	if !found {
+		return MediaFile{
+			Path:     filePath,
+			Kind:     kind,
+			Attrs:    media.Attributes{Type: kind, MimeType: mime.TypeByExtension(filepath.Ext(filePath))},
+			Date:     stat.ModTime(),
+			PeerID:   peerID,
+			Username: username,
+		}
+	}
+
+	return MediaFile{
+		Path: filePath,
+		Kind: kind,
+		Attrs: media.Attributes{
+			Type:      entry.Type,
+			MimeType:  entry.MimeType,
+			Duration:  entry.Duration,
+			Width:     entry.Width,
+			Height:    entry.Height,
+			Title:     entry.Title,
+			Performer: entry.Performer,
+		},
+		MediaID:   entry.MediaID,
+		MessageID: entry.MessageID,
+		Date:      entry.Date,
+		PeerID:    peerID,
+		Channel:   entry.Channel,
+		Username:  entry.Username,
+		Out:       entry.Direction == DirectionSent,
+		Version:   entry.Version,
+	}
+}
+
+// username returns the last known username of a peer
+func (h *MessageHandler) username(peerID int64) string {
+	if alias, found, err := h.Index.GetAlias(peerID); err == nil && found {
+		return alias.Username()
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gotd/td/telegram/message/peer"
+	"github.com/gotd/td/tg"
+)
+
+// ResolveTargets resolves every USER_TARGET entry to a peer ID, prints a report
+// and remembers the IDs for filtering. Entries that cannot be resolved fall back
+// to the ID saved by an earlier run.
+func (h *MessageHandler) ResolveTargets(ctx context.Context, resolver peer.Resolver) error {
+	if len(h.UserTarget) == 0 {
+		fmt.Println("No USER_TARGET configured, archiving all chats")
+		return nil
+	}
+
+	saved, err := h.Index.Targets()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Resolving targets:")
+	ids := map[int64]bool{}
+	var failed []string
+	for _, target := range h.UserTarget {
+		id, err := resolveTarget(ctx, resolver, target)
+		if err != nil {
+			if prev, ok := saved[target]; ok {
+				ids[prev] = true
+				fmt.Printf("  %s: not resolved (%v), using saved ID %d\n", target, err, prev)
+				continue
+			}
+			failed = append(failed, target)
+			fmt.Printf("  %s: not resolved: %v\n", target, err)
+			continue
+		}
+
+		ids[id] = true
+		fmt.Printf("  %s: %d\n", target, id)
+		if err := h.Index.SetTarget(target, id); err != nil {
+			fmt.Printf("Error saving target %s: %v\n", target, err)
+		}
+	}
+	h.targetIDs = ids
+
+	if len(failed) > 0 {
+		fmt.Printf("Warning: %d of %d targets could not be resolved and will not be archived: %s\n",
+			len(failed), len(h.UserTarget), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// resolveTarget returns the peer ID of a USER_TARGET entry.
+// Numeric IDs are used as is, phone numbers start with a plus sign
+// and everything else is resolved as a username.
+func resolveTarget(ctx context.Context, resolver peer.Resolver, target string) (int64, error) {
+	if id, err := strconv.ParseInt(target, 10, 64); err == nil {
+		return id, nil
+	}
+
+	var p tg.InputPeerClass
+	var err error
+	if strings.HasPrefix(target, "+") {
+		p, err = resolver.ResolvePhone(ctx, target)
+	} else {
+		p, err = resolver.ResolveDomain(ctx, strings.TrimPrefix(target, "@"))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := p.(type) {
+	case *tg.InputPeerUser:
+		return v.UserID, nil
+	case *tg.InputPeerChannel:
+		return v.ChannelID, nil
+	case *tg.InputPeerChat:
+		return v.ChatID, nil
+	}
+	return 0, fmt.Errorf("unsupported peer type %T", p)
+}
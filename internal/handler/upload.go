@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/archive"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/media"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/processor"
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// MediaFile describes a local media file and the message it belongs to
+type MediaFile struct {
+	Path      string
+	Kind      string
+	Attrs     media.Attributes
+	MediaID   int64
+	MessageID int
+	Date      time.Time
+	EditDate  time.Time
+	Caption   string
+	Entities  []archive.Entity
+	PeerID    int64
+	Channel   bool
+	Username  string
+	// Out is set for messages sent by the account
+	Out bool
+	// Version counts media replacements of the message, starting at 1
+	Version int
+}
+
+// ArchiveFile uploads a local media file using the configured object naming,
+// records it in the index and runs post-processing.
+// It returns the object name and a link to the uploaded object.
+func (h *MessageHandler) ArchiveFile(ctx context.Context, f MediaFile) (string, string, error) {
+	metadata := f.Attrs.Metadata()
+	metadata["Message-Id"] = strconv.Itoa(f.MessageID)
+	metadata["Message-Date"] = f.Date.UTC().Format(time.RFC3339)
+	metadata["Peer-Id"] = strconv.FormatInt(f.PeerID, 10)
+	metadata["Direction"] = direction(f.Out)
+	if f.Version > 1 {
+		metadata["Version"] = strconv.Itoa(f.Version)
+		metadata["Edit-Date"] = f.EditDate.UTC().Format(time.RFC3339)
+	}
+
+	template := KeyTemplate(h.Config)
+
+	// Read and optionally strip EXIF data before the file leaves the machine.
+	// The capture time is also needed when the object key contains it.
+	var captureTime time.Time
+	if h.Config.ExifMetadata || h.Config.StripExif || usesCaptureTime(template) {
+		if info, err := media.ReadExif(f.Path); err == nil {
+			captureTime = info.CaptureTime
+			if h.Config.ExifMetadata {
+				maps.Copy(metadata, info.Metadata(!h.Config.StripExif))
+			}
+		}
+	}
+	if h.Config.StripExif {
+		if _, err := media.StripExif(f.Path); err != nil {
+			return "", "", fmt.Errorf("strip exif: %w", err)
+		}
+	}
+
+	// Get file info for upload
+	fileInfo, err := os.Stat(f.Path)
+	if err != nil {
+		return "", "", fmt.Errorf("get file info: %w", err)
+	}
+
+	// Enforce the peer's storage quota
+	limits := h.quotaLimits(f.PeerID, f.Username)
+	routePrefix, err := h.reserveQuota(ctx, f.PeerID, f.Username, limits, fileInfo.Size())
+	if err != nil {
+		return "", "", err
+	}
+
+	// Open the file for reading
+	file, err := os.Open(f.Path)
+	if err != nil {
+		h.releaseQuota(f.PeerID, limits, fileInfo.Size())
+		return "", "", fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	// Upload to MinIO
+	objectName := RenderKey(template, KeyFields{
+		PeerID:      f.PeerID,
+		Username:    f.Username,
+		Kind:        f.Kind,
+		Filename:    fileInfo.Name(),
+		Direction:   direction(f.Out),
+		Date:        f.Date,
+		CaptureTime: captureTime,
+	})
+	objectName = VersionedKey(objectName, f.Version)
+	if routePrefix != "" {
+		objectName = path.Join(routePrefix, objectName)
+	}
+	contentType := f.Attrs.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	url, err := h.Storage.UploadFile(ctx, objectName, file, fileInfo.Size(), store.UploadOptions{
+		ContentType: contentType,
+		Metadata:    metadata,
+		Tags:        f.Attrs.Tags(),
+	})
+	if err != nil {
+		h.releaseQuota(f.PeerID, limits, fileInfo.Size())
+		return "", "", fmt.Errorf("upload file: %w", err)
+	}
+	h.alertUsage(ctx, f.PeerID, f.Username, limits)
+
+	// Record the object in the local index
+	err = h.Index.Put(index.Entry{
+		Key:       objectName,
+		MediaID:   f.MediaID,
+		Version:   f.Version,
+		PeerID:    f.PeerID,
+		Channel:   f.Channel,
+		Username:  f.Username,
+		Direction: direction(f.Out),
+		MessageID: f.MessageID,
+		Date:      f.Date,
+		Type:      f.Attrs.Type,
+		MimeType:  contentType,
+		Size:      fileInfo.Size(),
+		Duration:  f.Attrs.Duration,
+		Width:     f.Attrs.Width,
+		Height:    f.Attrs.Height,
+		Title:     f.Attrs.Title,
+		Performer: f.Attrs.Performer,
+	})
+	if err != nil {
+		fmt.Printf("Error indexing %s: %v\n", objectName, err)
+	}
+
+	// Store the message details next to the object
+	sidecar := archive.Sidecar{
+		Key:       objectName,
+		MessageID: f.MessageID,
+		PeerID:    f.PeerID,
+		Username:  f.Username,
+		Date:      f.Date.UTC(),
+		MediaID:   f.MediaID,
+		Version:   max(f.Version, 1),
+		Caption:   f.Caption,
+		Entities:  f.Entities,
+	}
+	if !f.EditDate.IsZero() {
+		edited := f.EditDate.UTC()
+		sidecar.EditDate = &edited
+	}
+	if err := h.writeSidecar(ctx, sidecar); err != nil {
+		fmt.Printf("Error writing sidecar of %s: %v\n", objectName, err)
+	}
+
+	fmt.Printf("File uploaded to %s\n", url)
+
+	// Run post-processing steps on the uploaded file
+	h.postProcess(ctx, &processor.Object{
+		Key:      objectName,
+		Path:     f.Path,
+		Kind:     f.Kind,
+		Metadata: map[string]string{},
+	})
+
+	return objectName, url, nil
+}
+
+// postProcess runs the configured processors and stores the metadata they produce.
+// Failures are reported but do not fail the upload.
+func (h *MessageHandler) postProcess(ctx context.Context, obj *processor.Object) {
+	if len(h.Processors) == 0 {
+		return
+	}
+
+	if err := h.Processors.Run(ctx, obj); err != nil {
+		fmt.Printf("Error post-processing %s: %v\n", obj.Key, err)
+	}
+
+	if len(obj.Metadata) > 0 {
+		if err := h.Storage.UpdateMetadata(ctx, obj.Key, obj.Metadata); err != nil {
+			fmt.Printf("Error updating metadata of %s: %v\n", obj.Key, err)
+		}
+	}
+}
+
+// direction returns the direction of a message as used in object names
+func direction(out bool) string {
+	if out {
+		return DirectionSent
+	}
+	return DirectionReceived
+}
+
+// writeSidecar uploads the sidecar of an archived object
+func (h *MessageHandler) writeSidecar(ctx context.Context, sidecar archive.Sidecar) error {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode sidecar: %w", err)
+	}
+
+	_, err = h.Storage.UploadFile(ctx, archive.SidecarKey(sidecar.Key), bytes.NewReader(data), int64(len(data)), store.UploadOptions{
+		ContentType: "application/json",
+	})
+	return err
+}
+
+// readSidecar downloads the sidecar of an archived object
+func (h *MessageHandler) readSidecar(ctx context.Context, objectName string) (archive.Sidecar, error) {
+	var sidecar archive.Sidecar
+	reader, err := h.Storage.DownloadFile(ctx, archive.SidecarKey(objectName))
+	if err != nil {
+		return sidecar, err
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(&sidecar); err != nil {
+		return sidecar, fmt.Errorf("decode sidecar: %w", err)
+	}
+	return sidecar, nil
+}
@@ -0,0 +1,159 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var aliasBucket = []byte("aliases")
+
+// Alias holds the known names of a peer over time
+type Alias struct {
+	ID        int64       `json:"id"`
+	Usernames []AliasName `json:"usernames,omitempty"`
+	Names     []AliasName `json:"names,omitempty"`
+	Phone     string      `json:"phone,omitempty"`
+}
+
+// AliasName is a name a peer used and when it was seen
+type AliasName struct {
+	Value     string    `json:"value"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Username returns the most recent username of the peer
+func (a Alias) Username() string {
+	return latest(a.Usernames)
+}
+
+// Name returns the most recent display name of the peer
+func (a Alias) Name() string {
+	return latest(a.Names)
+}
+
+// HasUsername reports whether the peer ever used the username
+func (a Alias) HasUsername(username string) bool {
+	for _, u := range a.Usernames {
+		if strings.EqualFold(u.Value, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordAlias adds the current username, display name and phone of a peer
+// to its history
+func (i *Index) RecordAlias(id int64, username, name, phone string, at time.Time) error {
+	return i.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(aliasBucket)
+		alias := Alias{ID: id}
+		if data := bucket.Get(aliasKey(id)); data != nil {
+			if err := json.Unmarshal(data, &alias); err != nil {
+				return err
+			}
+		}
+
+		alias.Usernames = seen(alias.Usernames, username, at)
+		alias.Names = seen(alias.Names, name, at)
+		if phone != "" {
+			alias.Phone = phone
+		}
+
+		data, err := json.Marshal(alias)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(aliasKey(id), data)
+	})
+}
+
+// GetAlias returns the alias history of a peer
+func (i *Index) GetAlias(id int64) (Alias, bool, error) {
+	var alias Alias
+	var found bool
+	err := i.view(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(aliasBucket).Get(aliasKey(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &alias)
+	})
+	return alias, found, err
+}
+
+// FindAlias looks up a peer by numeric ID, current or past username, or phone number
+func (i *Index) FindAlias(query string) (Alias, bool, error) {
+	if id, err := strconv.ParseInt(query, 10, 64); err == nil {
+		return i.GetAlias(id)
+	}
+
+	username := strings.TrimPrefix(query, "@")
+	phone := NormalizePhone(query)
+
+	var alias Alias
+	var found bool
+	err := i.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(aliasBucket).ForEach(func(_, data []byte) error {
+			var a Alias
+			if err := json.Unmarshal(data, &a); err != nil {
+				return err
+			}
+			if a.HasUsername(username) || (strings.HasPrefix(query, "+") && a.Phone == phone) {
+				alias, found = a, true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return Alias{}, false, fmt.Errorf("failed to find alias: %w", err)
+	}
+
+	return alias, found, nil
+}
+
+// NormalizePhone keeps only the digits of a phone number
+func NormalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// seen marks a value as seen at the given time, adding it to the history if new
+func seen(names []AliasName, value string, at time.Time) []AliasName {
+	if value == "" {
+		return names
+	}
+	for i := range names {
+		if names[i].Value == value {
+			names[i].LastSeen = at
+			return names
+		}
+	}
+	return append(names, AliasName{Value: value, FirstSeen: at, LastSeen: at})
+}
+
+// latest returns the most recently seen value
+func latest(names []AliasName) string {
+	var result AliasName
+	for _, n := range names {
+		if n.LastSeen.After(result.LastSeen) || result.Value == "" {
+			result = n
+		}
+	}
+	return result.Value
+}
+
+// aliasKey returns the key of a peer in the aliases bucket
+func aliasKey(id int64) []byte {
+	return []byte(strconv.FormatInt(id, 10))
+}
@@ -0,0 +1,190 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	mediaBucket   = []byte("media")
+	messageBucket = []byte("messages")
+)
+
+// Index is a local database of archived objects.
+// The database is opened per transaction so command line tools can read it
+// while the bot is running.
+type Index struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Entry describes an archived media object
+type Entry struct {
+	Key       string    `json:"key"`
+	MediaID   int64     `json:"media_id,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	PeerID    int64     `json:"peer_id"`
+	Channel   bool      `json:"channel,omitempty"`
+	Username  string    `json:"username"`
+	Direction string    `json:"direction,omitempty"`
+	MessageID int       `json:"message_id"`
+	Date      time.Time `json:"date"`
+	Type      string    `json:"type"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration,omitempty"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Performer string    `json:"performer,omitempty"`
+	// DeletedAt is set once the message was deleted in Telegram
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Filter selects entries in a query. Zero values match everything.
+type Filter struct {
+	PeerID      int64
+	Username    string
+	Type        string
+	Direction   string
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Since       time.Time
+	Until       time.Time
+	// IncludeDeleted also matches media of deleted messages
+	IncludeDeleted bool
+}
+
+// Open creates an index stored at path
+func Open(path string) (*Index, error) {
+	idx := &Index{path: path}
+
+	// Create the database and buckets up front
+	err := idx.update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{mediaBucket, messageBucket, aliasBucket, targetBucket, uploadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+
+	return idx, nil
+}
+
+// Put stores or replaces an entry.
+// The entry also becomes the latest version of its message.
+func (i *Index) Put(entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode entry: %w", err)
+	}
+
+	return i.update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(mediaBucket).Put([]byte(entry.Key), data); err != nil {
+			return err
+		}
+		if entry.MessageID == 0 {
+			return nil
+		}
+		return addMessageKey(tx, entry.Ref(), entry.Key)
+	})
+}
+
+// Get returns the entry stored for an object key
+func (i *Index) Get(key string) (Entry, bool, error) {
+	var entry Entry
+	var found bool
+	err := i.view(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(mediaBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, found, err
+}
+
+// Query returns all entries matching the filter
+func (i *Index) Query(f Filter) ([]Entry, error) {
+	var entries []Entry
+	err := i.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(mediaBucket).ForEach(func(_, data []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			if f.Match(entry) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query index: %w", err)
+	}
+
+	return entries, nil
+}
+
+// Match reports whether an entry satisfies the filter
+func (f Filter) Match(e Entry) bool {
+	duration := time.Duration(e.Duration * float64(time.Second))
+	switch {
+	case !f.IncludeDeleted && e.DeletedAt != nil:
+		return false
+	case f.PeerID != 0 && f.PeerID != e.PeerID:
+		return false
+	case f.Username != "" && f.Username != e.Username:
+		return false
+	case f.Type != "" && f.Type != e.Type:
+		return false
+	case f.Direction != "" && f.Direction != e.Direction:
+		return false
+	case f.MinDuration > 0 && duration < f.MinDuration:
+		return false
+	case f.MaxDuration > 0 && duration > f.MaxDuration:
+		return false
+	case !f.Since.IsZero() && e.Date.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && e.Date.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// update runs a read-write transaction
+func (i *Index) update(fn func(tx *bbolt.Tx) error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	db, err := bbolt.Open(i.path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(fn)
+}
+
+// view runs a read-only transaction
+func (i *Index) view(fn func(tx *bbolt.Tx) error) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	db, err := bbolt.Open(i.path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(fn)
+}
@@ -0,0 +1,179 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// MessageRef identifies a message. Message IDs are unique per account for
+// private chats and groups, and unique per channel for channels.
+type MessageRef struct {
+	ChannelID int64
+	MessageID int
+}
+
+// Ref returns the message the entry belongs to
+func (e Entry) Ref() MessageRef {
+	ref := MessageRef{MessageID: e.MessageID}
+	if e.Channel {
+		ref.ChannelID = e.PeerID
+	}
+	return ref
+}
+
+// key returns the key of the message in the messages bucket
+func (r MessageRef) key() []byte {
+	if r.ChannelID != 0 {
+		return []byte(fmt.Sprintf("c%d:%d", r.ChannelID, r.MessageID))
+	}
+	return []byte(fmt.Sprintf("m%d", r.MessageID))
+}
+
+// addMessageKey appends an object key to the versions of a message
+func addMessageKey(tx *bbolt.Tx, ref MessageRef, objectName string) error {
+	bucket := tx.Bucket(messageBucket)
+
+	var keys []string
+	if data := bucket.Get(ref.key()); data != nil {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if key == objectName {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(append(keys, objectName))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(ref.key(), data)
+}
+
+// MessageEntries returns the entries of all media versions archived for a message,
+// oldest first
+func (i *Index) MessageEntries(ref MessageRef) ([]Entry, error) {
+	var entries []Entry
+	err := i.view(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(messageBucket).Get(ref.key())
+		if data == nil {
+			return nil
+		}
+
+		var keys []string
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			data := tx.Bucket(mediaBucket).Get([]byte(key))
+			if data == nil {
+				continue
+			}
+			var entry Entry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %w", err)
+	}
+
+	return entries, nil
+}
+
+// GetMessage returns the entry of the latest media archived for a message
+func (i *Index) GetMessage(ref MessageRef) (Entry, bool, error) {
+	entries, err := i.MessageEntries(ref)
+	if err != nil || len(entries) == 0 {
+		return Entry{}, false, err
+	}
+	return entries[len(entries)-1], true, nil
+}
+
+// renameMessageKey replaces an object key among the versions of a message
+func renameMessageKey(tx *bbolt.Tx, ref MessageRef, objectName, newName string) error {
+	bucket := tx.Bucket(messageBucket)
+	data := bucket.Get(ref.key())
+	if data == nil {
+		return nil
+	}
+
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for i, key := range keys {
+		if key == objectName {
+			keys[i] = newName
+		}
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(ref.key(), data)
+}
+
+// MoveEntry records that an object was renamed, keeping it attached to its message
+func (i *Index) MoveEntry(objectName, newName string) error {
+	return i.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(mediaBucket)
+		data := bucket.Get([]byte(objectName))
+		if data == nil {
+			return nil
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entry.Key = newName
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Delete([]byte(objectName)); err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(newName), data); err != nil {
+			return err
+		}
+		if entry.MessageID == 0 {
+			return nil
+		}
+		return renameMessageKey(tx, entry.Ref(), objectName, newName)
+	})
+}
+
+// MarkDeleted records that the message of an entry was deleted
+func (i *Index) MarkDeleted(objectName string, at time.Time) error {
+	return i.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(mediaBucket)
+		data := bucket.Get([]byte(objectName))
+		if data == nil {
+			return nil
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entry.DeletedAt = &at
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(objectName), data)
+	})
+}
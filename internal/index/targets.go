@@ -0,0 +1,42 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+var targetBucket = []byte("targets")
+
+// SetTarget stores the peer ID a USER_TARGET entry resolved to
+func (i *Index) SetTarget(target string, id int64) error {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	return i.update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(targetBucket).Put([]byte(target), data)
+	})
+}
+
+// Targets returns the peer IDs of previously resolved USER_TARGET entries
+func (i *Index) Targets() (map[string]int64, error) {
+	targets := map[string]int64{}
+	err := i.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(targetBucket).ForEach(func(k, v []byte) error {
+			var id int64
+			if err := json.Unmarshal(v, &id); err != nil {
+				return err
+			}
+			targets[string(k)] = id
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets: %w", err)
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,93 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var uploadBucket = []byte("uploads")
+
+// Upload is an unfinished multipart upload that can be resumed
+type Upload struct {
+	Bucket   string       `json:"bucket"`
+	Key      string       `json:"key"`
+	UploadID string       `json:"upload_id"`
+	SHA256   string       `json:"sha256"`
+	Size     int64        `json:"size"`
+	PartSize int64        `json:"part_size"`
+	Parts    []UploadPart `json:"parts"`
+	Started  time.Time    `json:"started"`
+	Updated  time.Time    `json:"updated"`
+}
+
+// UploadPart is a part of a multipart upload stored in the bucket
+type UploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	MD5    string `json:"md5"`
+	Size   int64  `json:"size"`
+}
+
+// uploadKey returns the database key of an upload
+func uploadKey(bucket, key string) []byte {
+	return []byte(bucket + "/" + key)
+}
+
+// PutUpload stores the progress of a multipart upload
+func (i *Index) PutUpload(upload Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+
+	return i.update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(uploadBucket).Put(uploadKey(upload.Bucket, upload.Key), data)
+	})
+}
+
+// GetUpload returns the unfinished upload of an object
+func (i *Index) GetUpload(bucket, key string) (Upload, bool, error) {
+	var upload Upload
+	var found bool
+	err := i.view(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(uploadBucket).Get(uploadKey(bucket, key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &upload)
+	})
+	return upload, found, err
+}
+
+// DeleteUpload forgets an upload once it completed or was aborted
+func (i *Index) DeleteUpload(bucket, key string) error {
+	return i.update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(uploadBucket).Delete(uploadKey(bucket, key))
+	})
+}
+
+// Uploads returns the unfinished uploads to a bucket
+func (i *Index) Uploads(bucket string) ([]Upload, error) {
+	var uploads []Upload
+	err := i.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(uploadBucket).ForEach(func(_, data []byte) error {
+			var upload Upload
+			if err := json.Unmarshal(data, &upload); err != nil {
+				return err
+			}
+			if upload.Bucket == bucket {
+				uploads = append(uploads, upload)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploads: %w", err)
+	}
+
+	return uploads, nil
+}
@@ -0,0 +1,172 @@
+package media
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/gotd/td/tg"
+)
+
+// Attributes holds the details Telegram sends along with a media file
+type Attributes struct {
+	// Type is photo, video, round, audio, voice or document
+	Type              string
+	MimeType          string
+	FileName          string
+	Duration          float64
+	Width             int
+	Height            int
+	SupportsStreaming bool
+	Title             string
+	Performer         string
+	Waveform          []byte
+}
+
+// AttributesFromMedia collects the attributes of a message media
+func AttributesFromMedia(m tg.MessageMediaClass) Attributes {
+	switch med := m.(type) {
+	case *tg.MessageMediaPhoto:
+		attrs := Attributes{Type: "photo", MimeType: "image/jpeg"}
+		if photo, ok := med.Photo.(*tg.Photo); ok {
+			for _, size := range photo.Sizes {
+				if s, ok := size.(*tg.PhotoSize); ok && s.W*s.H > attrs.Width*attrs.Height {
+					attrs.Width, attrs.Height = s.W, s.H
+				}
+			}
+		}
+		return attrs
+	case *tg.MessageMediaDocument:
+		if doc, ok := med.Document.(*tg.Document); ok {
+			return AttributesFromDocument(doc)
+		}
+	}
+	return Attributes{}
+}
+
+// AttributesFromDocument collects the attributes of a document
+func AttributesFromDocument(doc *tg.Document) Attributes {
+	attrs := Attributes{Type: "document", MimeType: doc.MimeType}
+	for _, attr := range doc.Attributes {
+		switch a := attr.(type) {
+		case *tg.DocumentAttributeFilename:
+			attrs.FileName = a.FileName
+		case *tg.DocumentAttributeVideo:
+			attrs.Type = "video"
+			if a.RoundMessage {
+				attrs.Type = "round"
+			}
+			attrs.Duration = a.Duration
+			attrs.Width = a.W
+			attrs.Height = a.H
+			attrs.SupportsStreaming = a.SupportsStreaming
+		case *tg.DocumentAttributeAudio:
+			attrs.Type = "audio"
+			if a.Voice {
+				attrs.Type = "voice"
+			}
+			attrs.Duration = float64(a.Duration)
+			attrs.Title = a.Title
+			attrs.Performer = a.Performer
+			attrs.Waveform = a.Waveform
+		}
+	}
+	return attrs
+}
+
+// Metadata converts the attributes to object metadata
+func (a Attributes) Metadata() map[string]string {
+	metadata := map[string]string{}
+	if a.Type != "" {
+		metadata["Media-Type"] = a.Type
+	}
+	if a.Duration > 0 {
+		metadata["Duration"] = strconv.FormatFloat(a.Duration, 'f', -1, 64)
+	}
+	if a.Width > 0 && a.Height > 0 {
+		metadata["Width"] = strconv.Itoa(a.Width)
+		metadata["Height"] = strconv.Itoa(a.Height)
+	}
+	if a.Type == "video" {
+		metadata["Supports-Streaming"] = strconv.FormatBool(a.SupportsStreaming)
+	}
+	if a.Title != "" {
+		metadata["Title"] = MetadataValue(a.Title)
+	}
+	if a.Performer != "" {
+		metadata["Performer"] = MetadataValue(a.Performer)
+	}
+	if len(a.Waveform) > 0 {
+		metadata["Waveform"] = base64.StdEncoding.EncodeToString(a.Waveform)
+	}
+	return metadata
+}
+
+// Tags converts the attributes to object tags usable in bucket queries and policies
+func (a Attributes) Tags() map[string]string {
+	tags := map[string]string{}
+	if a.Type != "" {
+		tags["media-type"] = a.Type
+	}
+	if a.Duration > 0 {
+		tags["duration"] = strconv.Itoa(int(a.Duration))
+	}
+	if a.Width > 0 && a.Height > 0 {
+		tags["resolution"] = fmt.Sprintf("%dx%d", a.Width, a.Height)
+	}
+	if v := tagValue(a.Performer); v != "" {
+		tags["performer"] = v
+	}
+	if v := tagValue(a.Title); v != "" {
+		tags["title"] = v
+	}
+	return tags
+}
+
+// MetadataValue encodes a value so it can be sent as an HTTP header.
+// Non-ASCII text is stored as an RFC 2047 encoded word.
+func MetadataValue(value string) string {
+	for _, r := range value {
+		if r < 0x20 || r > 0x7e {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
+
+// tagValue keeps only the characters allowed in S3 tag values
+func tagValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return -1
+	}, value)
+
+	value = strings.TrimSpace(value)
+	if len(value) > 256 {
+		value = value[:256]
+	}
+	return value
+}
+
+// MediaID returns the Telegram ID of the photo or document in a message media,
+// or zero if it has none
+func MediaID(m tg.MessageMediaClass) int64 {
+	switch med := m.(type) {
+	case *tg.MessageMediaPhoto:
+		if photo, ok := med.Photo.(*tg.Photo); ok {
+			return photo.ID
+		}
+	case *tg.MessageMediaDocument:
+		if doc, ok := med.Document.(*tg.Document); ok {
+			return doc.ID
+		}
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ExifInfo holds the capture details parsed from an image's EXIF data
+type ExifInfo struct {
+	CaptureTime time.Time
+	Make        string
+	Model       string
+	HasGPS      bool
+	Latitude    float64
+	Longitude   float64
+}
+
+// ReadExif parses EXIF data from the image at path
+func ReadExif(path string) (*ExifInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	x, err := exif.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("decode exif: %w", err)
+	}
+
+	info := &ExifInfo{
+		Make:  exifString(x, exif.Make),
+		Model: exifString(x, exif.Model),
+	}
+	if t, err := x.DateTime(); err == nil {
+		info.CaptureTime = t
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		info.HasGPS = true
+		info.Latitude = lat
+		info.Longitude = long
+	}
+
+	return info, nil
+}
+
+// Metadata converts the EXIF details to object metadata.
+// GPS coordinates are left out when includeGPS is false.
+func (e *ExifInfo) Metadata(includeGPS bool) map[string]string {
+	metadata := map[string]string{}
+	if !e.CaptureTime.IsZero() {
+		metadata["Capture-Time"] = e.CaptureTime.Format(time.RFC3339)
+	}
+	if e.Make != "" {
+		metadata["Camera-Make"] = e.Make
+	}
+	if e.Model != "" {
+		metadata["Camera-Model"] = e.Model
+	}
+	if includeGPS && e.HasGPS {
+		metadata["Gps-Latitude"] = strconv.FormatFloat(e.Latitude, 'f', 6, 64)
+		metadata["Gps-Longitude"] = strconv.FormatFloat(e.Longitude, 'f', 6, 64)
+	}
+	return metadata
+}
+
+// exifString returns a printable string value of a tag or an empty string
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+
+	// Object metadata only accepts printable ASCII
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, value))
+}
+
+const (
+	tagGPSPointer  = 0x8825
+	tagExifPointer = 0x8769
+)
+
+// identifyingTags are blanked when stripping EXIF data
+var identifyingTags = map[uint16]bool{
+	0x013B: true, // Artist
+	0x9C9D: true, // XPAuthor
+	0x927C: true, // MakerNote
+	0x9286: true, // UserComment
+	0xA420: true, // ImageUniqueID
+	0xA430: true, // CameraOwnerName
+	0xA431: true, // BodySerialNumber
+	0xA435: true, // LensSerialNumber
+}
+
+// typeSizes maps TIFF field types to their size in bytes
+var typeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// StripExif removes GPS and identifying tags from a JPEG file in place.
+// The EXIF layout is kept so the remaining tags stay readable.
+// It reports whether the file was changed.
+func StripExif(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("read file: %w", err)
+	}
+
+	tiff := findExifSegment(data)
+	if tiff == nil {
+		return false, nil
+	}
+
+	changed, err := stripTIFF(tiff)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return false, fmt.Errorf("write file: %w", err)
+	}
+	return true, nil
+}
+
+// findExifSegment returns the TIFF payload of the JPEG APP1 Exif segment.
+// The returned slice shares memory with data.
+func findExifSegment(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		marker := data[pos+1]
+		// Start of scan, no more metadata segments follow
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil
+		}
+		segment := data[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// stripTIFF blanks the GPS directory and identifying tags of a TIFF structure
+func stripTIFF(tiff []byte) (bool, error) {
+	if len(tiff) < 8 {
+		return false, fmt.Errorf("exif data too short")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false, fmt.Errorf("invalid exif byte order")
+	}
+
+	s := &tiffStripper{data: tiff, order: order}
+	s.walk(order.Uint32(tiff[4:]), true)
+	return s.changed, nil
+}
+
+type tiffStripper struct {
+	data    []byte
+	order   binary.ByteOrder
+	changed bool
+}
+
+// walk blanks identifying tags in the directory at offset and follows
+// sub-directory pointers when root is true
+func (s *tiffStripper) walk(offset uint32, root bool) {
+	entries, ok := s.entries(offset)
+	if !ok {
+		return
+	}
+
+	for _, entry := range entries {
+		tag := s.order.Uint16(s.data[entry:])
+		switch {
+		case tag == tagGPSPointer:
+			s.clearDir(s.order.Uint32(s.data[entry+8:]))
+		case tag == tagExifPointer && root:
+			s.walk(s.order.Uint32(s.data[entry+8:]), false)
+		case identifyingTags[tag]:
+			s.zeroValue(entry)
+		}
+	}
+}
+
+// clearDir blanks every value in a directory and marks it empty
+func (s *tiffStripper) clearDir(offset uint32) {
+	entries, ok := s.entries(offset)
+	if !ok || len(entries) == 0 {
+		return
+	}
+	for _, entry := range entries {
+		s.zeroValue(entry)
+	}
+	s.order.PutUint16(s.data[offset:], 0)
+	s.changed = true
+}
+
+// entries returns the offsets of the entries of the directory at offset
+func (s *tiffStripper) entries(offset uint32) ([]uint32, bool) {
+	if uint64(offset)+2 > uint64(len(s.data)) {
+		return nil, false
+	}
+	count := uint32(s.order.Uint16(s.data[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(s.data)) {
+		return nil, false
+	}
+
+	entries := make([]uint32, count)
+	for i := range entries {
+		entries[i] = offset + 2 + uint32(i)*12
+	}
+	return entries, true
+}
+
+// zeroValue overwrites the value of the entry at offset with zero bytes
+func (s *tiffStripper) zeroValue(entry uint32) {
+	size, ok := typeSizes[s.order.Uint16(s.data[entry+2:])]
+	if !ok {
+		return
+	}
+	length := uint64(size) * uint64(s.order.Uint32(s.data[entry+4:]))
+
+	// Values up to four bytes are stored inline
+	start := uint64(entry + 8)
+	if length > 4 {
+		start = uint64(s.order.Uint32(s.data[entry+8:]))
+	}
+	if start+length > uint64(len(s.data)) {
+		return
+	}
+
+	clear(s.data[start : start+length])
+	s.changed = true
+}
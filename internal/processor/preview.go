@@ -0,0 +1,139 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	// Register decoders for the supported source formats
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+
+	store "github.com/rizkirmdhnnn/teleminio-uploader/internal/storage"
+)
+
+// PreviewPrefix is the bucket prefix that mirrors archived images with previews
+const PreviewPrefix = "previews"
+
+// PreviewProcessor generates resized JPEG previews for uploaded images
+type PreviewProcessor struct {
+	Storage store.Storage
+	Sizes   []int
+	Quality int
+}
+
+// NewPreviewProcessor creates a preview processor for the given sizes
+func NewPreviewProcessor(backend store.Storage, sizes []int) *PreviewProcessor {
+	return &PreviewProcessor{
+		Storage: backend,
+		Sizes:   sizes,
+		Quality: 85,
+	}
+}
+
+// Name returns the processor name
+func (p *PreviewProcessor) Name() string {
+	return "preview"
+}
+
+// Process decodes JPEG, PNG and GIF images and uploads a preview per size
+func (p *PreviewProcessor) Process(ctx context.Context, obj *Object) error {
+	file, err := os.Open(obj.Path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	// Skip files that are not supported images
+	src, format, err := image.Decode(file)
+	if err != nil {
+		return nil
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	obj.Metadata["Width"] = strconv.Itoa(width)
+	obj.Metadata["Height"] = strconv.Itoa(height)
+
+	for _, size := range p.Sizes {
+		data, err := p.resize(src, size)
+		if err != nil {
+			return fmt.Errorf("resize %s to %d: %w", format, size, err)
+		}
+
+		_, err = p.Storage.UploadFile(ctx, PreviewKey(obj.Key, size), bytes.NewReader(data), int64(len(data)), store.UploadOptions{
+			ContentType: "image/jpeg",
+			Metadata: map[string]string{
+				"Source":          obj.Key,
+				"Original-Width":  strconv.Itoa(width),
+				"Original-Height": strconv.Itoa(height),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("upload preview %d: %w", size, err)
+		}
+	}
+
+	return nil
+}
+
+// resize scales the image so its longest side fits size and encodes it as JPEG.
+// Images smaller than size are encoded without upscaling.
+func (p *PreviewProcessor) resize(src image.Image, size int) ([]byte, error) {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			height = max(1, height*size/width)
+			width = size
+		} else {
+			width = max(1, width*size/height)
+			height = size
+		}
+	}
+
+	// JPEG has no alpha channel, so flatten transparent images onto white
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: p.Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ListPreviews returns the object names of all previews stored for an object,
+// including sizes that are no longer configured
+func ListPreviews(ctx context.Context, backend store.Storage, objectName string) ([]string, error) {
+	prefix := strings.TrimSuffix(PreviewKey(objectName, 0), "0.jpg")
+	objects, err := backend.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, obj := range objects {
+		// Skip previews of other objects sharing the prefix, such as later versions
+		size := strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".jpg")
+		if _, err := strconv.Atoi(size); err == nil {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys, nil
+}
+
+// PreviewKey returns the object name of a preview for the given object and size
+func PreviewKey(objectName string, size int) string {
+	base := strings.TrimSuffix(objectName, path.Ext(objectName))
+	return fmt.Sprintf("%s/%s_%d.jpg", PreviewPrefix, base, size)
+}
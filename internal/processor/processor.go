@@ -0,0 +1,41 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Object describes a file that has been uploaded to storage
+type Object struct {
+	// Key is the object name in the bucket
+	Key string
+	// Path is the local path of the uploaded file
+	Path string
+	// Kind is the media type directory (photo, video or document)
+	Kind string
+	// Metadata collects values to be stored on the uploaded object
+	Metadata map[string]string
+}
+
+// Processor runs a post-processing step on an uploaded object
+type Processor interface {
+	Name() string
+	Process(ctx context.Context, obj *Object) error
+}
+
+// Chain runs processors in order after an upload succeeds
+type Chain []Processor
+
+// Run executes every processor on the object.
+// A failing processor does not stop the others; all errors are reported.
+func (c Chain) Run(ctx context.Context, obj *Object) error {
+	var errs []error
+	for _, p := range c {
+		if err := p.Process(ctx, obj); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,153 @@
+package quota
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+)
+
+// Level is how far a peer's usage is into its quota
+type Level int
+
+const (
+	Normal Level = iota
+	Soft
+	Hard
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case Soft:
+		return "soft"
+	case Hard:
+		return "hard"
+	}
+	return "ok"
+}
+
+// Tracker keeps the bytes stored per peer, updated as files are uploaded
+// and removed
+type Tracker struct {
+	mu     sync.Mutex
+	usage  map[int64]int64
+	levels map[int64]Level
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{
+		usage:  map[int64]int64{},
+		levels: map[int64]Level{},
+	}
+}
+
+// Load sums the sizes of the indexed objects of every peer. Objects marked as
+// deleted are only counted when they are still stored.
+func (t *Tracker) Load(idx *index.Index, countDeleted bool) error {
+	entries, err := idx.Query(index.Filter{IncludeDeleted: countDeleted})
+	if err != nil {
+		return fmt.Errorf("failed to load quota usage: %w", err)
+	}
+
+	usage := map[int64]int64{}
+	for _, e := range entries {
+		usage[e.PeerID] += e.Size
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.usage = usage
+	return nil
+}
+
+// Usage returns the bytes stored for a peer
+func (t *Tracker) Usage(peerID int64) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.usage[peerID]
+}
+
+// All returns the bytes stored for every peer
+func (t *Tracker) All() map[int64]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[int64]int64, len(t.usage))
+	for id, n := range t.usage {
+		result[id] = n
+	}
+	return result
+}
+
+// Add changes a peer's usage and returns the new usage along with the quota
+// level, reporting whether the level went up since the last change
+func (t *Tracker) Add(peerID, delta int64, limits config.Quota) (int64, Level, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.usage[peerID] += delta
+	if t.usage[peerID] < 0 {
+		t.usage[peerID] = 0
+	}
+
+	level := LevelOf(t.usage[peerID], limits)
+	raised := level > t.levels[peerID]
+	t.levels[peerID] = level
+	return t.usage[peerID], level, raised
+}
+
+// Reserve adds size to a peer's usage if that stays within the hard quota, so
+// concurrent uploads cannot overshoot it together. It returns the usage and
+// whether the size was added; a reservation is given back with Add.
+func (t *Tracker) Reserve(peerID, size int64, limits config.Quota) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	usage := t.usage[peerID]
+	if limits.Hard > 0 && (usage >= limits.Hard || usage+size > limits.Hard) {
+		return usage, false
+	}
+	t.usage[peerID] = usage + size
+	return t.usage[peerID], true
+}
+
+// Raise records that a peer reached a level and reports whether it is
+// higher than the level recorded before, so each alert is sent once
+func (t *Tracker) Raise(peerID int64, level Level) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if level <= t.levels[peerID] {
+		return false
+	}
+	t.levels[peerID] = level
+	return true
+}
+
+// LevelOf returns the quota level of a usage
+func LevelOf(usage int64, limits config.Quota) Level {
+	switch {
+	case limits.Hard > 0 && usage >= limits.Hard:
+		return Hard
+	case limits.Soft > 0 && usage >= limits.Soft:
+		return Soft
+	}
+	return Normal
+}
+
+// FormatBytes formats a byte count with a binary unit
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
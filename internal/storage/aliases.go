@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/contrib/storage"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+)
+
+// AliasPeerStorage records username and display name changes of peers
+// in the alias index as they are stored
+type AliasPeerStorage struct {
+	storage.PeerStorage
+	Index *index.Index
+
+	mu   sync.Mutex
+	seen map[int64]string
+}
+
+// NewAliasPeerStorage wraps a peer storage to maintain the alias index
+func NewAliasPeerStorage(peers storage.PeerStorage, idx *index.Index) *AliasPeerStorage {
+	return &AliasPeerStorage{
+		PeerStorage: peers,
+		Index:       idx,
+		seen:        map[int64]string{},
+	}
+}
+
+// Add stores the peer and updates its alias history
+func (s *AliasPeerStorage) Add(ctx context.Context, value storage.Peer) error {
+	if err := s.PeerStorage.Add(ctx, value); err != nil {
+		return err
+	}
+	return s.record(value)
+}
+
+// Assign stores a resolved peer and updates its alias history
+func (s *AliasPeerStorage) Assign(ctx context.Context, key string, value storage.Peer) error {
+	if err := s.PeerStorage.Assign(ctx, key, value); err != nil {
+		return err
+	}
+	return s.record(value)
+}
+
+// record adds the peer's names to the alias index
+func (s *AliasPeerStorage) record(value storage.Peer) error {
+	id, username, name, phone := PeerNames(value)
+	if id == 0 {
+		return nil
+	}
+
+	// Only touch the index when something changed since the last update
+	fingerprint := strings.Join([]string{username, name, phone}, "\x00")
+	s.mu.Lock()
+	unchanged := s.seen[id] == fingerprint
+	s.seen[id] = fingerprint
+	s.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	if err := s.Index.RecordAlias(id, username, name, phone, time.Now().UTC()); err != nil {
+		return fmt.Errorf("record alias: %w", err)
+	}
+	return nil
+}
+
+// PeerNames returns the ID, username, display name and phone of a stored peer
+func PeerNames(p storage.Peer) (id int64, username, name, phone string) {
+	switch {
+	case p.User != nil:
+		name = strings.TrimSpace(p.User.FirstName + " " + p.User.LastName)
+		return p.User.ID, p.User.Username, name, index.NormalizePhone(p.User.Phone)
+	case p.Channel != nil:
+		return p.Channel.ID, p.Channel.Username, p.Channel.Title, ""
+	case p.Chat != nil:
+		return p.Chat.ID, "", p.Chat.Title, ""
+	}
+	return p.Key.ID, "", "", ""
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Batcher collects small uploads for a short window and sends them to the
+// bucket in a single Snowball request, a tar stream MinIO extracts server-side
+type Batcher struct {
+	Window     time.Duration
+	MaxSize    int64
+	MaxObjects int
+
+	client  *MinioClient
+	mu      sync.Mutex
+	pending []*batchItem
+	timer   *time.Timer
+}
+
+// batchItem is an upload waiting for its batch to be sent
+type batchItem struct {
+	name string
+	data []byte
+	opts minio.PutObjectOptions
+	done chan error
+}
+
+// NewBatcher creates a batcher uploading through a MinIO client
+func NewBatcher(client *MinioClient, window time.Duration, maxSize int64, maxObjects int) *Batcher {
+	if window <= 0 {
+		window = 2 * time.Second
+	}
+	if maxSize <= 0 {
+		maxSize = 1024 * 1024
+	}
+	if maxObjects <= 0 {
+		maxObjects = 100
+	}
+
+	return &Batcher{
+		Window:     window,
+		MaxSize:    maxSize,
+		MaxObjects: maxObjects,
+		client:     client,
+	}
+}
+
+// accepts reports whether an object of a size is small enough to be batched
+func (b *Batcher) accepts(size int64) bool {
+	return size >= 0 && size <= b.MaxSize
+}
+
+// Put queues an object for the next batch and waits until it was stored
+func (b *Batcher) Put(ctx context.Context, objectName string, data []byte, opts minio.PutObjectOptions) error {
+	item := &batchItem{name: objectName, data: data, opts: opts, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	switch {
+	case len(b.pending) >= b.MaxObjects:
+		go b.send(b.take())
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.Window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take removes and returns the pending uploads; b.mu must be held
+func (b *Batcher) take() []*batchItem {
+	items := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return items
+}
+
+// flush sends the pending uploads once the window is over
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	items := b.take()
+	b.mu.Unlock()
+
+	b.send(items)
+}
+
+// send uploads a batch, falling back to individual uploads when the batch fails
+func (b *Batcher) send(items []*batchItem) {
+	if len(items) == 0 {
+		return
+	}
+	ctx := context.Background()
+
+	if len(items) > 1 {
+		objects := make(chan minio.SnowballObject, len(items))
+		for _, item := range items {
+			objects <- minio.SnowballObject{
+				Key:     item.name,
+				Size:    int64(len(item.data)),
+				ModTime: time.Now(),
+				Content: bytes.NewReader(item.data),
+				Headers: item.opts.Header(),
+			}
+		}
+		close(objects)
+
+		err := b.client.Client.PutObjectsSnowball(ctx, b.client.BucketName, minio.SnowballOptions{
+			InMemory: true,
+			Compress: true,
+		}, objects)
+		if err == nil {
+			fmt.Printf("Uploaded %d files in one batch\n", len(items))
+			for _, item := range items {
+				item.done <- nil
+			}
+			return
+		}
+		fmt.Printf("Batch upload of %d files failed, uploading them one by one: %v\n", len(items), err)
+	}
+
+	for _, item := range items {
+		_, err := b.client.Client.PutObject(ctx, b.client.BucketName, item.name, bytes.NewReader(item.data), int64(len(item.data)), item.opts)
+		item.done <- err
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrUnavailable is returned while the storage circuit breaker is open
+var ErrUnavailable = errors.New("storage is unavailable")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets calls through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects calls until the cooldown is over
+	BreakerOpen
+	// BreakerHalfOpen waits for a probe to decide whether storage recovered
+	BreakerHalfOpen
+)
+
+// String returns the name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker stops calls to storage after repeated failures, so requests fail
+// fast while it is down instead of each waiting for a timeout
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewBreaker creates a closed breaker that opens after threshold failures in a row
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &Breaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// State returns the current state
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether calls may go to storage
+func (b *Breaker) Allow() bool {
+	return b.State() == BreakerClosed
+}
+
+// Success records a successful call and closes the breaker
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		fmt.Println("Storage is available again, closing circuit breaker")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+// Failure records a failed call and opens the breaker once the threshold is
+// reached or a probe failed
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.Threshold) {
+		if b.state == BreakerClosed {
+			fmt.Printf("Storage failed %d times in a row, opening circuit breaker for %s\n", b.failures, b.Cooldown)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Trip opens the breaker right away, for example when storage is down at startup
+func (b *Breaker) Trip() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+// Ready moves an open breaker to half-open once the cooldown is over and
+// reports whether a probe should be sent
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerOpen || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+	b.state = BreakerHalfOpen
+	return true
+}
+
+// IsUnavailable reports whether an error means storage could not be reached,
+// as opposed to storage rejecting the request
+func IsUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		return resp.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	cooldown := 20 * time.Millisecond
+	b := NewBreaker(3, cooldown)
+
+	expect := func(step string, want BreakerState) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Fatalf("%s: breaker is %s, want %s", step, got, want)
+		}
+		if b.Allow() != (want == BreakerClosed) {
+			t.Fatalf("%s: Allow() = %v in state %s", step, b.Allow(), want)
+		}
+	}
+
+	expect("new breaker", BreakerClosed)
+	b.Failure()
+	b.Failure()
+	expect("below the threshold", BreakerClosed)
+	b.Success()
+	b.Failure()
+	b.Failure()
+	expect("a success resets the count", BreakerClosed)
+	b.Failure()
+	expect("threshold reached", BreakerOpen)
+
+	if b.Ready() {
+		t.Fatal("open breaker is ready before the cooldown is over")
+	}
+	time.Sleep(cooldown)
+	if !b.Ready() {
+		t.Fatal("open breaker is not ready after the cooldown")
+	}
+	expect("after the cooldown", BreakerHalfOpen)
+	if b.Ready() {
+		t.Fatal("half-open breaker asks for a second probe")
+	}
+
+	b.Failure()
+	expect("failed probe", BreakerOpen)
+	time.Sleep(cooldown)
+	if !b.Ready() {
+		t.Fatal("breaker is not ready after a failed probe and the cooldown")
+	}
+	b.Success()
+	expect("successful probe", BreakerClosed)
+
+	b.Trip()
+	expect("tripped", BreakerOpen)
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"canceled", context.Canceled, false},
+		{"breaker open", fmt.Errorf("upload: %w", ErrUnavailable), true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"server error", minio.ErrorResponse{StatusCode: 503, Code: "SlowDown"}, true},
+		{"rejected request", minio.ErrorResponse{StatusCode: 403, Code: "AccessDenied"}, false},
+		{"other error", errors.New("checksum mismatch"), false},
+	}
+	for _, tt := range tests {
+		if got := IsUnavailable(tt.err); got != tt.want {
+			t.Errorf("%s: IsUnavailable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// outageStorage records uploads and fails them while it is down
+type outageStorage struct {
+	Storage
+
+	mu     sync.Mutex
+	down   bool
+	events []string
+}
+
+func (o *outageStorage) setDown(down bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.down = down
+}
+
+func (o *outageStorage) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *outageStorage) recorded() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.events...)
+}
+
+func (o *outageStorage) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	o.mu.Lock()
+	down := o.down
+	o.mu.Unlock()
+	if down {
+		return "", &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return "", err
+	}
+	o.record("upload " + objectName)
+	return "url", nil
+}
+
+func (o *outageStorage) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.down {
+		return false, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+	return false, nil
+}
+
+func TestSpooledRecovery(t *testing.T) {
+	backend := &outageStorage{}
+	s, err := NewSpooled(backend, t.TempDir(), config.Config{
+		BreakerThreshold: 2,
+		BreakerCooldown:  20 * time.Millisecond,
+		SpoolMaxSize:     1 << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Failures open the breaker, and uploads are spooled from then on
+	backend.setDown(true)
+	for _, name := range []string{"a", "b", "c"} {
+		url, err := s.UploadFile(ctx, name, strings.NewReader(name), 1, UploadOptions{})
+		if err != nil {
+			t.Fatalf("upload of %s while storage is down: %v", name, err)
+		}
+		if url != "" {
+			t.Errorf("spooled upload of %s returned link %q", name, url)
+		}
+	}
+	if s.Breaker.State() != BreakerOpen {
+		t.Fatalf("breaker is %s after failed uploads, want open", s.Breaker.State())
+	}
+
+	// The setup hook runs ahead of every drain until it succeeds
+	attempts := 0
+	s.Recovered = func(ctx context.Context) error {
+		attempts++
+		backend.record(fmt.Sprintf("recovered %d", attempts))
+		if attempts == 1 {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+	go s.Run(ctx)
+
+	// Probes keep failing while storage is down
+	time.Sleep(60 * time.Millisecond)
+	if events := backend.recorded(); len(events) != 0 {
+		t.Fatalf("storage was used while it is down: %v", events)
+	}
+
+	backend.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(backend.recorded()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	want := "[recovered 1 upload a upload b upload c recovered 2]"
+	if got := fmt.Sprint(backend.recorded()); got != want {
+		t.Errorf("after recovery storage saw %s, want %s", got, want)
+	}
+	if s.Breaker.State() != BreakerClosed {
+		t.Errorf("breaker is %s after recovery, want closed", s.Breaker.State())
+	}
+	if _, ok := s.spooled("a"); ok {
+		t.Error("uploaded file is still spooled")
+	}
+}
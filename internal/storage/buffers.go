@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// BufferPool hands out part buffers within a memory budget shared by all
+// uploads, so concurrent large uploads cannot exhaust memory
+type BufferPool struct {
+	limit int64
+	sem   *semaphore.Weighted
+
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+// NewBufferPool creates a pool allowing limit bytes of buffers in use at once
+func NewBufferPool(limit int64) *BufferPool {
+	return &BufferPool{
+		limit: limit,
+		sem:   semaphore.NewWeighted(limit),
+		pools: map[int]*sync.Pool{},
+	}
+}
+
+// Reserve waits until n bytes of the budget are free and returns a function
+// that gives them back. A request larger than the budget runs on its own.
+func (p *BufferPool) Reserve(ctx context.Context, n int64) (func(), error) {
+	n = min(n, p.limit)
+	if err := p.sem.Acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	return func() { p.sem.Release(n) }, nil
+}
+
+// Get returns a buffer of size bytes once the budget allows it
+func (p *BufferPool) Get(ctx context.Context, size int) ([]byte, error) {
+	if _, err := p.Reserve(ctx, int64(size)); err != nil {
+		return nil, err
+	}
+	if buf, ok := p.pool(size).Get().(*[]byte); ok {
+		return *buf, nil
+	}
+	return make([]byte, size), nil
+}
+
+// Put returns a buffer taken with Get
+func (p *BufferPool) Put(buf []byte) {
+	buf = buf[:cap(buf)]
+	p.pool(len(buf)).Put(&buf)
+	p.sem.Release(min(int64(len(buf)), p.limit))
+}
+
+// pool returns the free list of buffers of a size
+func (p *BufferPool) pool(size int) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool, ok := p.pools[size]
+	if !ok {
+		pool = &sync.Pool{}
+		p.pools[size] = pool
+	}
+	return pool
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// MetaSHA256 is the metadata key holding the hex SHA-256 of a stored object
+const MetaSHA256 = "Sha256"
+
+// uploadAttempts is how often an upload failing verification is tried
+const uploadAttempts = 3
+
+// ErrChecksumMismatch is returned when a stored object does not match the data that was sent
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// castagnoli is the CRC32C table used by S3 checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// digestReader computes the SHA-256 and CRC32C of everything read through it
+type digestReader struct {
+	reader io.Reader
+	sha256 hash.Hash
+	crc32c hash.Hash32
+	size   int64
+}
+
+func newDigestReader(reader io.Reader) *digestReader {
+	return &digestReader{
+		reader: reader,
+		sha256: sha256.New(),
+		crc32c: crc32.New(castagnoli),
+	}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	if n > 0 {
+		d.sha256.Write(p[:n])
+		d.crc32c.Write(p[:n])
+		d.size += int64(n)
+	}
+	return n, err
+}
+
+// SHA256 returns the hex SHA-256 of the data read so far
+func (d *digestReader) SHA256() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+// CRC32C returns the CRC32C of the data read so far, base64 encoded like S3 checksums
+func (d *digestReader) CRC32C() string {
+	return base64.StdEncoding.EncodeToString(d.crc32c.Sum(nil))
+}
+
+// Size returns the number of bytes read so far
+func (d *digestReader) Size() int64 {
+	return d.size
+}
+
+// summedBody is a replayable upload body whose SHA-256 from start is already
+// known, so the layers it passes through do not read it again to hash it
+type summedBody struct {
+	io.ReadSeeker
+	start int64
+	sum   string
+}
+
+// bodySHA256 returns the SHA-256 of a body from start, reading the rest of it
+// only when the digest is not known yet
+func bodySHA256(body io.ReadSeeker, start int64) (string, error) {
+	if s, ok := body.(*summedBody); ok && s.start == start {
+		return s.sum, nil
+	}
+	return sha256Of(body)
+}
+
+// withSHA256 hashes a body once for every layer below and rewinds it to start
+func withSHA256(body io.ReadSeeker, start int64) (io.ReadSeeker, error) {
+	if s, ok := body.(*summedBody); ok && s.start == start {
+		return s, nil
+	}
+	sum, err := sha256Of(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file: %w", err)
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind upload: %w", err)
+	}
+	return &summedBody{ReadSeeker: body, start: start, sum: sum}, nil
+}
+
+// sha256Of hashes the rest of a reader
+func sha256Of(reader io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
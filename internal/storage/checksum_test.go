@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReplayableHashesSpooledData(t *testing.T) {
+	data := strings.Repeat("spooled data ", 1000)
+	want := sha256.Sum256([]byte(data))
+
+	// A reader that cannot seek is spooled and hashed on the way
+	body, cleanup, err := replayable(io.MultiReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if _, ok := body.(*summedBody); !ok {
+		t.Fatalf("spooled body is a %T, want a *summedBody", body)
+	}
+
+	// Layers below reuse the spool and its digest
+	again, _, err := replayable(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != body {
+		t.Error("a spooled body was spooled again")
+	}
+	sum, err := bodySHA256(again, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != hex.EncodeToString(want[:]) {
+		t.Errorf("SHA-256 is %s, want %x", sum, want)
+	}
+	if got, _ := io.ReadAll(again); string(got) != data {
+		t.Error("spooled body differs from the data")
+	}
+}
+
+func TestWithSHA256(t *testing.T) {
+	data := []byte("skip this|hash this")
+	want := sha256.Sum256(data[10:])
+
+	reader := bytes.NewReader(data)
+	if _, err := reader.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	body, err := withSHA256(reader, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos, _ := body.Seek(0, io.SeekCurrent); pos != 10 {
+		t.Errorf("body was left at offset %d, want 10", pos)
+	}
+	if sum, _ := bodySHA256(body, 10); sum != hex.EncodeToString(want[:]) {
+		t.Errorf("SHA-256 is %s, want %x", sum, want)
+	}
+
+	// A digest from another offset is not reused
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := bodySHA256(body, 0); sum == hex.EncodeToString(want[:]) {
+		t.Error("digest of offset 10 was used for offset 0")
+	}
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// Metadata keys describing how an object was compressed
+const (
+	MetaCompression  = "Compression"
+	MetaOriginalSize = "Original-Size"
+)
+
+// Supported compression algorithms
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// DefaultCompressibleTypes are the MIME types compressed when none are configured
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/javascript",
+	"application/x-yaml",
+	"application/yaml",
+	"application/sql",
+	"application/csv",
+}
+
+// incompressibleTypes are never compressed, whatever is configured,
+// because their contents are compressed already
+var incompressibleTypes = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/pdf",
+}
+
+// Compressed compresses files of configured MIME types before they reach the
+// wrapped backend and decompresses them on download
+type Compressed struct {
+	Storage
+	Algorithm string
+	Types     []string
+}
+
+// NewCompressed creates a compressing backend from the compression settings
+func NewCompressed(backend Storage, cfg config.Config) (*Compressed, error) {
+	switch cfg.Compression {
+	case CompressionZstd, CompressionGzip:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+
+	types := cfg.CompressionTypes
+	if len(types) == 0 {
+		types = DefaultCompressibleTypes
+	}
+
+	return &Compressed{Storage: backend, Algorithm: cfg.Compression, Types: types}, nil
+}
+
+// Unwrap returns the backend compressed objects are stored in
+func (c *Compressed) Unwrap() Storage {
+	return c.Storage
+}
+
+// compressible reports whether files of a content type should be compressed
+func (c *Compressed) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return !matchesType(incompressibleTypes, mediaType) && matchesType(c.Types, mediaType)
+}
+
+// matchesType reports whether a media type matches one of the patterns, such as "text/*"
+func matchesType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadFile compresses files of compressible types and uploads them.
+// Files that do not get smaller are uploaded as they are.
+func (c *Compressed) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	if opts.ContentEncoding != "" || !c.compressible(opts.ContentType) {
+		return c.Storage.UploadFile(ctx, objectName, reader, size, opts)
+	}
+
+	// Keep the original around in case compression does not pay off
+	body, cleanup, err := replayable(reader)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	// Compress into a temporary file to learn the compressed size
+	tmp, err := os.CreateTemp("", "teleminio-compress-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to compress file: %w", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	original, err := c.compress(io.MultiWriter(tmp, hash), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress file: %w", err)
+	}
+	compressed, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress file: %w", err)
+	}
+
+	if compressed >= original {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return "", fmt.Errorf("failed to rewind upload: %w", err)
+		}
+		return c.Storage.UploadFile(ctx, objectName, body, original, opts)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to compress file: %w", err)
+	}
+
+	metadata := make(map[string]string, len(opts.Metadata)+2)
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaCompression] = c.Algorithm
+	metadata[MetaOriginalSize] = strconv.FormatInt(original, 10)
+
+	// The compressed data was hashed while it was written
+	upload := &summedBody{ReadSeeker: tmp, sum: hex.EncodeToString(hash.Sum(nil))}
+	return c.Storage.UploadFile(ctx, objectName, upload, compressed, UploadOptions{
+		ContentType:     opts.ContentType,
+		ContentEncoding: c.Algorithm,
+		Metadata:        metadata,
+		Tags:            opts.Tags,
+	})
+}
+
+// compress writes the compressed reader to w and returns the uncompressed size
+func (c *Compressed) compress(w io.Writer, reader io.Reader) (int64, error) {
+	var zw io.WriteCloser
+	var err error
+	switch c.Algorithm {
+	case CompressionZstd:
+		zw, err = zstd.NewWriter(w)
+	default:
+		zw, err = gzip.NewWriterLevel(w, gzip.BestCompression)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(zw, reader)
+	if err != nil {
+		zw.Close()
+		return 0, err
+	}
+	return n, zw.Close()
+}
+
+// decompressReader returns a reader that decompresses data of the given algorithm
+func decompressReader(algorithm string, reader io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case CompressionZstd:
+		zr, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		return zr, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// DownloadFile downloads a file, decompressing it when it was stored compressed
+func (c *Compressed) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	info, err := c.Storage.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := c.Storage.DownloadFile(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := info.UserMetadata[MetaCompression]
+	if algorithm == "" {
+		return reader, nil
+	}
+
+	body, err := decompressReader(algorithm, reader)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", objectName, err)
+	}
+	return &decompressedFile{ReadCloser: body, file: reader}, nil
+}
+
+// GetObjectInfo reports the original size of compressed objects
+func (c *Compressed) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	info, err := c.Storage.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return info, err
+	}
+	if info.UserMetadata[MetaCompression] == "" {
+		return info, nil
+	}
+
+	if size, err := strconv.ParseInt(info.UserMetadata[MetaOriginalSize], 10, 64); err == nil {
+		info.Size = size
+	}
+	return info, nil
+}
+
+// decompressedFile closes both the decompressor and the underlying download
+type decompressedFile struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (d *decompressedFile) Close() error {
+	d.ReadCloser.Close()
+	return d.file.Close()
+}
@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// EncryptionScheme identifies the format of client-side encrypted objects
+const EncryptionScheme = "aes-256-gcm-stream-v1"
+
+// Metadata keys describing how an object was encrypted
+const (
+	MetaEncryption           = "Encryption"
+	MetaEncryptionWrap       = "Encryption-Wrap"
+	MetaEncryptionKey        = "Encryption-Key"
+	MetaEncryptionNonce      = "Encryption-Nonce"
+	MetaPlaintextSize        = "Plaintext-Size"
+	MetaPlaintextContentType = "Plaintext-Content-Type"
+	MetaPlaintextEncoding    = "Plaintext-Content-Encoding"
+)
+
+// Ways a data key can be wrapped
+const (
+	WrapMasterKey = "master"
+	WrapAge       = "age"
+)
+
+const (
+	// encryptionChunkSize is the size of the plaintext chunks sealed one by one
+	encryptionChunkSize = 64 * 1024
+	// noncePrefixSize is the random part of each chunk nonce, followed by a
+	// 4 byte chunk counter and a byte marking the last chunk
+	noncePrefixSize = 7
+)
+
+// Encrypted encrypts files before they reach the wrapped backend and decrypts
+// them on download. Every object gets its own data key, which is wrapped by
+// a master key or for a list of age recipients and kept in object metadata.
+type Encrypted struct {
+	Storage
+	MasterKey  []byte
+	Recipients []age.Recipient
+	Identities []age.Identity
+}
+
+// NewEncrypted creates an encrypting backend from the encryption settings
+func NewEncrypted(backend Storage, cfg config.Config) (*Encrypted, error) {
+	e := &Encrypted{Storage: backend}
+
+	if cfg.EncryptionMasterKey != "" {
+		key, err := ParseKey(cfg.EncryptionMasterKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_MASTER_KEY: %w", err)
+		}
+		e.MasterKey = key
+	}
+
+	if len(cfg.EncryptionRecipients) > 0 {
+		recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(cfg.EncryptionRecipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_RECIPIENTS: %w", err)
+		}
+		e.Recipients = recipients
+	}
+
+	if cfg.EncryptionIdentityFile != "" {
+		file, err := os.Open(cfg.EncryptionIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		defer file.Close()
+
+		identities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file: %w", err)
+		}
+		e.Identities = identities
+	}
+
+	if e.MasterKey == nil && e.Recipients == nil {
+		return nil, fmt.Errorf("client-side encryption needs ENCRYPTION_MASTER_KEY or ENCRYPTION_RECIPIENTS")
+	}
+
+	return e, nil
+}
+
+// ParseKey decodes a 256-bit key given as hex or base64
+func ParseKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key must be hex or base64 encoded")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// Unwrap returns the backend encrypted objects are stored in
+func (e *Encrypted) Unwrap() Storage {
+	return e.Storage
+}
+
+// UploadFile encrypts a file with a fresh data key and uploads it
+func (e *Encrypted) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	wrap, wrapped, err := e.wrapKey(dataKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Encryption parameters travel with the object
+	metadata := make(map[string]string, len(opts.Metadata)+6)
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaEncryption] = EncryptionScheme
+	metadata[MetaEncryptionWrap] = wrap
+	metadata[MetaEncryptionKey] = base64.StdEncoding.EncodeToString(wrapped)
+	metadata[MetaEncryptionNonce] = base64.StdEncoding.EncodeToString(prefix)
+	if opts.ContentType != "" {
+		metadata[MetaPlaintextContentType] = opts.ContentType
+	}
+	if opts.ContentEncoding != "" {
+		metadata[MetaPlaintextEncoding] = opts.ContentEncoding
+	}
+
+	encryptedSize := int64(-1)
+	if size >= 0 {
+		metadata[MetaPlaintextSize] = strconv.FormatInt(size, 10)
+		encryptedSize = EncryptedSize(size)
+	}
+
+	return e.Storage.UploadFile(ctx, objectName, newEncryptReader(aead, prefix, reader), encryptedSize, UploadOptions{
+		ContentType: "application/octet-stream",
+		Metadata:    metadata,
+		Tags:        opts.Tags,
+	})
+}
+
+// DownloadFile downloads a file, decrypting it when it was stored encrypted
+func (e *Encrypted) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	info, err := e.Storage.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := e.Storage.DownloadFile(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if info.UserMetadata[MetaEncryption] == "" {
+		return reader, nil
+	}
+
+	decrypted, err := e.Decrypt(reader, info.UserMetadata)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", objectName, err)
+	}
+	return decrypted, nil
+}
+
+// GetObjectInfo reports the plaintext size and content type of encrypted objects
+func (e *Encrypted) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	info, err := e.Storage.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return info, err
+	}
+	if info.UserMetadata[MetaEncryption] == "" {
+		return info, nil
+	}
+
+	if size, err := strconv.ParseInt(info.UserMetadata[MetaPlaintextSize], 10, 64); err == nil {
+		info.Size = size
+	}
+	if contentType := info.UserMetadata[MetaPlaintextContentType]; contentType != "" {
+		info.ContentType = contentType
+	}
+	return info, nil
+}
+
+// Decrypt returns a reader that decrypts an object stored with the given metadata
+func (e *Encrypted) Decrypt(reader io.ReadCloser, metadata map[string]string) (io.ReadCloser, error) {
+	if scheme := metadata[MetaEncryption]; scheme != EncryptionScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[MetaEncryptionKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	prefix, err := base64.StdEncoding.DecodeString(metadata[MetaEncryptionNonce])
+	if err != nil || len(prefix) != noncePrefixSize {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+
+	dataKey, err := e.unwrapKey(metadata[MetaEncryptionWrap], wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		aead:   aead,
+		prefix: prefix,
+		src:    bufio.NewReaderSize(reader, encryptionChunkSize+aead.Overhead()),
+		closer: reader,
+	}, nil
+}
+
+// wrapKey protects a data key for the configured age recipients, or with the master key
+func (e *Encrypted) wrapKey(dataKey []byte) (string, []byte, error) {
+	if len(e.Recipients) > 0 {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, e.Recipients...)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		if _, err := w.Write(dataKey); err != nil {
+			return "", nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return "", nil, fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		return WrapAge, buf.Bytes(), nil
+	}
+
+	aead, err := newGCM(e.MasterKey)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return WrapMasterKey, aead.Seal(nonce, nonce, dataKey, []byte(EncryptionScheme)), nil
+}
+
+// unwrapKey recovers a data key with the master key or the age identities
+func (e *Encrypted) unwrapKey(wrap string, wrapped []byte) ([]byte, error) {
+	switch wrap {
+	case WrapAge:
+		if len(e.Identities) == 0 {
+			return nil, fmt.Errorf("object key is wrapped for age recipients but no identity is configured")
+		}
+		r, err := age.Decrypt(bytes.NewReader(wrapped), e.Identities...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+		}
+		return io.ReadAll(r)
+
+	case WrapMasterKey:
+		if e.MasterKey == nil {
+			return nil, fmt.Errorf("object key is wrapped with a master key but none is configured")
+		}
+		aead, err := newGCM(e.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) < aead.NonceSize() {
+			return nil, fmt.Errorf("invalid wrapped key")
+		}
+		dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(EncryptionScheme))
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key: wrong master key")
+		}
+		return dataKey, nil
+	}
+
+	return nil, fmt.Errorf("unknown key wrapping %q", wrap)
+}
+
+// newGCM creates an AES-256-GCM cipher
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedSize returns the stored size of a plaintext of the given size
+func EncryptedSize(size int64) int64 {
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*16
+}
+
+// chunkNonce returns the nonce of a chunk; the last chunk is marked so that
+// truncating the object at a chunk boundary fails authentication
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptReader seals a plaintext stream chunk by chunk
+type encryptReader struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	src     *bufio.Reader
+	plain   []byte
+	out     []byte
+	counter uint32
+	done    bool
+}
+
+func newEncryptReader(aead cipher.AEAD, prefix []byte, src io.Reader) *encryptReader {
+	return &encryptReader{
+		aead:   aead,
+		prefix: prefix,
+		src:    bufio.NewReaderSize(src, encryptionChunkSize),
+		plain:  make([]byte, encryptionChunkSize),
+	}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk of plaintext
+func (r *encryptReader) seal() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	r.out = r.aead.Seal(r.out[:0], chunkNonce(r.prefix, r.counter, last), r.plain[:n], nil)
+	r.counter++
+	r.done = last
+	return nil
+}
+
+// decryptReader opens an encrypted stream chunk by chunk
+type decryptReader struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	src     *bufio.Reader
+	closer  io.Closer
+	sealed  []byte
+	out     []byte
+	counter uint32
+	done    bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk
+func (r *decryptReader) open() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, encryptionChunkSize+r.aead.Overhead())
+	}
+
+	n, err := io.ReadFull(r.src, r.sealed)
+	last := false
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := r.aead.Open(r.out[:0], chunkNonce(r.prefix, r.counter, last), r.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted data is corrupt or truncated")
+	}
+	r.out = plain
+	r.counter++
+	r.done = last
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.closer.Close()
+}
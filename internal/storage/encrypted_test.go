@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// captureStorage keeps the last uploaded object in memory
+type captureStorage struct {
+	Storage
+	data     []byte
+	metadata map[string]string
+}
+
+func (c *captureStorage) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	c.data = data
+	c.metadata = opts.Metadata
+	return "", nil
+}
+
+// encryptForTest encrypts plain and returns the stored bytes and metadata
+func encryptForTest(t *testing.T, e *Encrypted, plain []byte) ([]byte, map[string]string) {
+	t.Helper()
+
+	backend := &captureStorage{}
+	e.Storage = backend
+	if _, err := e.UploadFile(context.Background(), "object", bytes.NewReader(plain), int64(len(plain)), UploadOptions{}); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return backend.data, backend.metadata
+}
+
+// decryptForTest decrypts stored bytes
+func decryptForTest(e *Encrypted, sealed []byte, metadata map[string]string) ([]byte, error) {
+	reader, err := e.Decrypt(io.NopCloser(bytes.NewReader(sealed)), metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func newTestEncrypted(t *testing.T) *Encrypted {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &Encrypted{MasterKey: key}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e := newTestEncrypted(t)
+
+	sizes := []int{
+		0,
+		1,
+		encryptionChunkSize - 1,
+		encryptionChunkSize,
+		encryptionChunkSize + 1,
+		2 * encryptionChunkSize,
+		3*encryptionChunkSize + 17,
+	}
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		if _, err := rand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+
+		sealed, metadata := encryptForTest(t, e, plain)
+		if got, want := int64(len(sealed)), EncryptedSize(int64(size)); got != want {
+			t.Errorf("size %d: stored %d bytes, EncryptedSize reports %d", size, got, want)
+		}
+
+		got, err := decryptForTest(e, sealed, metadata)
+		if err != nil {
+			t.Errorf("size %d: decrypt: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted data differs from the plaintext", size)
+		}
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	e := newTestEncrypted(t)
+
+	plain := make([]byte, 3*encryptionChunkSize)
+	if _, err := rand.Read(plain); err != nil {
+		t.Fatal(err)
+	}
+	sealed, metadata := encryptForTest(t, e, plain)
+	chunk := encryptionChunkSize + 16
+
+	cases := map[string][]byte{
+		"empty":               nil,
+		"first chunk":         sealed[:chunk],
+		"two chunks":          sealed[:2*chunk],
+		"inside last chunk":   sealed[:len(sealed)-1],
+		"last chunk only":     sealed[2*chunk:],
+		"chunks out of order": append(append(append([]byte{}, sealed[chunk:2*chunk]...), sealed[:chunk]...), sealed[2*chunk:]...),
+	}
+	for name, data := range cases {
+		if _, err := decryptForTest(e, data, metadata); err == nil {
+			t.Errorf("%s: decrypting damaged data succeeded", name)
+		}
+	}
+}
+
+func TestEncryptedWrongKey(t *testing.T) {
+	sealed, metadata := encryptForTest(t, newTestEncrypted(t), []byte("secret"))
+
+	if _, err := decryptForTest(newTestEncrypted(t), sealed, metadata); err == nil {
+		t.Error("decrypting with another master key succeeded")
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// managedRulePrefix marks the lifecycle rules the bot owns; other rules are left alone
+const managedRulePrefix = "teleminio-"
+
+// ApplyPolicy reconciles the bucket's lifecycle, versioning and object lock
+// configuration with the declared policy, logging any drift it corrects
+func (m *MinioClient) ApplyPolicy(ctx context.Context, policy config.BucketPolicy) error {
+	var errs []error
+	if err := m.applyLifecycle(ctx, policy); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.applyVersioning(ctx, policy); err != nil {
+		errs = append(errs, err)
+	}
+	if err := m.applyObjectLock(ctx, policy); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// lifecycleRules builds the lifecycle rules declared by the policy
+func lifecycleRules(policy config.BucketPolicy) ([]lifecycle.Rule, error) {
+	var rules []lifecycle.Rule
+
+	for _, r := range policy.Expire {
+		for _, selector := range selectors(r.Selector) {
+			rules = append(rules, lifecycle.Rule{
+				ID:         managedRulePrefix + "expire-" + ruleName(selector),
+				Status:     "Enabled",
+				RuleFilter: ruleFilter(selector),
+				Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(r.Days)},
+			})
+		}
+	}
+
+	if len(policy.Transition) > 0 && policy.TransitionStorageClass == "" {
+		return nil, fmt.Errorf("LIFECYCLE_TRANSITION needs LIFECYCLE_TRANSITION_CLASS")
+	}
+	for _, r := range policy.Transition {
+		for _, selector := range selectors(r.Selector) {
+			rules = append(rules, lifecycle.Rule{
+				ID:         managedRulePrefix + "transition-" + ruleName(selector),
+				Status:     "Enabled",
+				RuleFilter: ruleFilter(selector),
+				Transition: lifecycle.Transition{
+					Days:         lifecycle.ExpirationDays(r.Days),
+					StorageClass: policy.TransitionStorageClass,
+				},
+			})
+		}
+	}
+
+	if policy.AbortMultipartDays > 0 {
+		rules = append(rules, lifecycle.Rule{
+			ID:     managedRulePrefix + "abort-multipart",
+			Status: "Enabled",
+			AbortIncompleteMultipartUpload: lifecycle.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: lifecycle.ExpirationDays(policy.AbortMultipartDays),
+			},
+		})
+	}
+
+	return rules, nil
+}
+
+// selectors splits a selector such as "video|round" into its alternatives.
+// A lifecycle filter matches a single tag value, so each one becomes a rule.
+func selectors(selector string) []string {
+	var result []string
+	for _, s := range strings.Split(selector, "|") {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// ruleFilter selects objects by key prefix, by exact media type tag, or all objects for "*"
+func ruleFilter(selector string) lifecycle.Filter {
+	switch {
+	case selector == "*":
+		return lifecycle.Filter{}
+	case strings.HasSuffix(selector, "/"):
+		return lifecycle.Filter{Prefix: selector}
+	}
+	return lifecycle.Filter{Tag: lifecycle.Tag{Key: "media-type", Value: selector}}
+}
+
+// ruleName turns a selector into a part of a rule ID
+func ruleName(selector string) string {
+	if selector == "*" {
+		return "all"
+	}
+	return strings.Trim(strings.NewReplacer("/", "-", " ", "-").Replace(selector), "-")
+}
+
+// describeRule summarizes the parts of a rule the bot manages, for comparison and logging
+func describeRule(r lifecycle.Rule) string {
+	var parts []string
+	if prefix := r.RuleFilter.Prefix + r.Prefix; prefix != "" {
+		parts = append(parts, "prefix="+prefix)
+	}
+	if r.RuleFilter.Tag.Key != "" {
+		parts = append(parts, fmt.Sprintf("tag=%s:%s", r.RuleFilter.Tag.Key, r.RuleFilter.Tag.Value))
+	}
+	if r.Expiration.Days > 0 {
+		parts = append(parts, fmt.Sprintf("expire=%dd", r.Expiration.Days))
+	}
+	if r.Transition.Days > 0 || r.Transition.StorageClass != "" {
+		parts = append(parts, fmt.Sprintf("transition=%dd:%s", r.Transition.Days, r.Transition.StorageClass))
+	}
+	if r.AbortIncompleteMultipartUpload.DaysAfterInitiation > 0 {
+		parts = append(parts, fmt.Sprintf("abort-multipart=%dd", r.AbortIncompleteMultipartUpload.DaysAfterInitiation))
+	}
+	parts = append(parts, "status="+r.Status)
+	return strings.Join(parts, " ")
+}
+
+// applyLifecycle replaces the bot's lifecycle rules when they drifted from the policy
+func (m *MinioClient) applyLifecycle(ctx context.Context, policy config.BucketPolicy) error {
+	desired, err := lifecycleRules(policy)
+	if err != nil {
+		return err
+	}
+
+	current, err := m.Client.GetBucketLifecycle(ctx, m.BucketName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return fmt.Errorf("failed to get bucket lifecycle: %w", err)
+		}
+		current = lifecycle.NewConfiguration()
+	}
+
+	// Rules that are not ours are kept as they are
+	var kept []lifecycle.Rule
+	existing := map[string]string{}
+	for _, r := range current.Rules {
+		if strings.HasPrefix(r.ID, managedRulePrefix) {
+			existing[r.ID] = describeRule(r)
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	var drift []string
+	wanted := map[string]bool{}
+	for _, r := range desired {
+		wanted[r.ID] = true
+		have, ok := existing[r.ID]
+		switch {
+		case !ok:
+			drift = append(drift, fmt.Sprintf("rule %s is missing (want %s)", r.ID, describeRule(r)))
+		case have != describeRule(r):
+			drift = append(drift, fmt.Sprintf("rule %s is %s (want %s)", r.ID, have, describeRule(r)))
+		}
+	}
+	for id, have := range existing {
+		if !wanted[id] {
+			drift = append(drift, fmt.Sprintf("rule %s (%s) is no longer declared", id, have))
+		}
+	}
+	if len(drift) == 0 {
+		return nil
+	}
+
+	sort.Strings(drift)
+	for _, d := range drift {
+		fmt.Printf("Bucket policy drift on %s: lifecycle %s\n", m.BucketName, d)
+	}
+
+	updated := lifecycle.NewConfiguration()
+	updated.Rules = append(kept, desired...)
+	if err := m.Client.SetBucketLifecycle(ctx, m.BucketName, updated); err != nil {
+		return fmt.Errorf("failed to set bucket lifecycle: %w", err)
+	}
+	fmt.Printf("Applied %d lifecycle rules to bucket %s\n", len(desired), m.BucketName)
+
+	return nil
+}
+
+// applyVersioning enables versioning when the policy asks for it
+func (m *MinioClient) applyVersioning(ctx context.Context, policy config.BucketPolicy) error {
+	current, err := m.Client.GetBucketVersioning(ctx, m.BucketName)
+	if err != nil {
+		return fmt.Errorf("failed to get bucket versioning: %w", err)
+	}
+
+	switch {
+	case policy.Versioning && !current.Enabled():
+		fmt.Printf("Bucket policy drift on %s: versioning is off (want enabled)\n", m.BucketName)
+		if err := m.Client.EnableVersioning(ctx, m.BucketName); err != nil {
+			return fmt.Errorf("failed to enable bucket versioning: %w", err)
+		}
+	case !policy.Versioning && current.Enabled() && policy.ObjectLockMode == "":
+		// Suspending versioning could drop history someone relies on
+		fmt.Printf("Bucket policy drift on %s: versioning is enabled but BUCKET_VERSIONING is off, leaving it enabled\n", m.BucketName)
+	}
+
+	return nil
+}
+
+// applyObjectLock sets the default retention when the policy declares one
+func (m *MinioClient) applyObjectLock(ctx context.Context, policy config.BucketPolicy) error {
+	if policy.ObjectLockMode == "" {
+		return nil
+	}
+
+	mode := minio.RetentionMode(policy.ObjectLockMode)
+	if !mode.IsValid() {
+		return fmt.Errorf("invalid OBJECT_LOCK_MODE %q, want GOVERNANCE or COMPLIANCE", policy.ObjectLockMode)
+	}
+	if policy.ObjectLockDays <= 0 {
+		return fmt.Errorf("OBJECT_LOCK_MODE needs OBJECT_LOCK_DAYS")
+	}
+
+	enabled, currentMode, validity, unit, err := m.Client.GetObjectLockConfig(ctx, m.BucketName)
+	if err != nil || enabled != "Enabled" {
+		fmt.Printf("Bucket policy drift on %s: object lock is not enabled and can only be turned on when the bucket is created\n", m.BucketName)
+		return nil
+	}
+
+	days := uint(policy.ObjectLockDays)
+	if currentMode != nil && *currentMode == mode && validity != nil && *validity == days && unit != nil && *unit == minio.Days {
+		return nil
+	}
+
+	have := "none"
+	if currentMode != nil && validity != nil && unit != nil {
+		have = fmt.Sprintf("%s for %d %s", *currentMode, *validity, *unit)
+	}
+	fmt.Printf("Bucket policy drift on %s: default retention is %s (want %s for %d DAYS)\n", m.BucketName, have, mode, days)
+
+	dayUnit := minio.Days
+	if err := m.Client.SetObjectLockConfig(ctx, m.BucketName, &mode, &days, &dayUnit); err != nil {
+		return fmt.Errorf("failed to set object lock retention: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+func TestLifecycleRules(t *testing.T) {
+	rules, err := lifecycleRules(config.BucketPolicy{
+		Expire: []config.LifecycleRule{
+			{Selector: "video|round", Days: 30},
+			{Selector: "trash/", Days: 7},
+			{Selector: "*", Days: 365},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"teleminio-expire-video": "tag=media-type:video expire=30d status=Enabled",
+		"teleminio-expire-round": "tag=media-type:round expire=30d status=Enabled",
+		"teleminio-expire-trash": "prefix=trash/ expire=7d status=Enabled",
+		"teleminio-expire-all":   "expire=365d status=Enabled",
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for _, r := range rules {
+		if got := describeRule(r); got != want[r.ID] {
+			t.Errorf("rule %s is %q, want %q", r.ID, got, want[r.ID])
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// localMetaDir is the directory under the storage root holding object attributes
+const localMetaDir = ".meta"
+
+// LocalStorage stores files in a directory on the local filesystem and
+// serves signed links to them through a built-in HTTP file server
+type LocalStorage struct {
+	Root    string
+	Addr    string
+	BaseURL string
+
+	secret []byte
+	mu     sync.Mutex
+}
+
+// localMeta holds the attributes of a stored file
+type localMeta struct {
+	ContentType     string            `json:"content_type,omitempty"`
+	ContentEncoding string            `json:"content_encoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+}
+
+// NewLocalStorage initializes a local filesystem backend
+func NewLocalStorage(cfg config.Config) (*LocalStorage, error) {
+	if err := os.MkdirAll(filepath.Join(cfg.LocalStorageDir, localMetaDir), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	// Without a configured secret links stay valid only until restart
+	secret := []byte(cfg.LocalStorageSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate link secret: %w", err)
+		}
+	}
+
+	return &LocalStorage{
+		Root:    cfg.LocalStorageDir,
+		Addr:    cfg.LocalStorageAddr,
+		BaseURL: strings.TrimSuffix(cfg.LocalStorageURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// filePath maps an object name to its location under the storage root
+func (l *LocalStorage) filePath(objectName string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+objectName), "/")
+	if name == "" || name == localMetaDir || strings.HasPrefix(name, localMetaDir+"/") {
+		return "", fmt.Errorf("invalid object name %q", objectName)
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(name)), nil
+}
+
+// metaPath returns the location of an object's attributes
+func (l *LocalStorage) metaPath(objectName string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+objectName), "/")
+	if name == "" {
+		return "", fmt.Errorf("invalid object name %q", objectName)
+	}
+	return filepath.Join(l.Root, localMetaDir, filepath.FromSlash(name)+".json"), nil
+}
+
+// readMeta loads an object's attributes, returning empty attributes when none were stored
+func (l *LocalStorage) readMeta(objectName string) (localMeta, error) {
+	var meta localMeta
+	metaPath, err := l.metaPath(objectName)
+	if err != nil {
+		return meta, err
+	}
+	data, err := os.ReadFile(metaPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, fmt.Errorf("failed to read object attributes: %w", err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to decode object attributes: %w", err)
+	}
+	return meta, nil
+}
+
+// writeMeta stores an object's attributes
+func (l *LocalStorage) writeMeta(objectName string, meta localMeta) error {
+	metaPath, err := l.metaPath(objectName)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode object attributes: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create attributes directory: %w", err)
+	}
+	if err := os.WriteFile(metaPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write object attributes: %w", err)
+	}
+	return nil
+}
+
+// canonicalMetadata normalizes metadata keys the way S3 servers return them
+func canonicalMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[http.CanonicalHeaderKey(k)] = v
+	}
+	return result
+}
+
+// UploadFile writes a file below the storage root
+func (l *LocalStorage) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	digest := newDigestReader(reader)
+	written, err := io.Copy(tmp, digest)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+	if size >= 0 && written != size {
+		return "", fmt.Errorf("failed to upload file: wrote %d of %d bytes", written, size)
+	}
+
+	metadata := canonicalMetadata(opts.Metadata)
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[MetaSHA256] = digest.SHA256()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+	err = l.writeMeta(objectName, localMeta{
+		ContentType:     opts.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		Metadata:        metadata,
+		Tags:            opts.Tags,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return l.GetFileURL(ctx, objectName, time.Hour*24*7) // URL valid for 7 days
+}
+
+// sign returns the signature of a link to an object expiring at the given time
+func (l *LocalStorage) sign(objectName string, expires int64) string {
+	mac := hmac.New(sha256.New, l.secret)
+	fmt.Fprintf(mac, "%s\n%d", objectName, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GetFileURL generates a signed link served by the built-in file server
+func (l *LocalStorage) GetFileURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	if _, err := l.filePath(objectName); err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(expiry).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", l.sign(objectName, expires))
+
+	return l.BaseURL + "/" + (&url.URL{Path: objectName}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// DownloadFile opens a stored file for reading
+func (l *LocalStorage) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	return file, nil
+}
+
+// ListFiles lists all stored files with an optional prefix
+func (l *LocalStorage) ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(l.Root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.Root, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if name == localMetaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".upload-") || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := l.GetObjectInfo(ctx, name)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	return objects, nil
+}
+
+// DeleteFile removes a stored file and its attributes
+func (l *LocalStorage) DeleteFile(ctx context.Context, objectName string) error {
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		return err
+	}
+	metaPath, err := l.metaPath(objectName)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Deleting a missing object is not an error, matching S3 semantics
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete file attributes: %w", err)
+	}
+
+	return nil
+}
+
+// GetObjectInfo gets information about a stored file
+func (l *LocalStorage) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to get object info: %w", err)
+	}
+	meta, err := l.readMeta(objectName)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := http.Header{}
+	if meta.ContentEncoding != "" {
+		header.Set("Content-Encoding", meta.ContentEncoding)
+	}
+
+	return ObjectInfo{
+		Key:          strings.TrimPrefix(path.Clean("/"+objectName), "/"),
+		Metadata:     header,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+		ContentType:  contentType,
+		ETag:         localETag(objectName, stat),
+		UserMetadata: meta.Metadata,
+		UserTags:     meta.Tags,
+		UserTagCount: len(meta.Tags),
+	}, nil
+}
+
+// localETag derives a stable entity tag from a file's name, size and modification time
+func localETag(objectName string, stat fs.FileInfo) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s:%d:%d", objectName, stat.Size(), stat.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:])
+}
+
+// UpdateMetadata merges metadata into a stored file's metadata
+func (l *LocalStorage) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	meta, err := l.readMeta(objectName)
+	if err != nil {
+		return err
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = make(map[string]string, len(metadata))
+	}
+	for k, v := range canonicalMetadata(metadata) {
+		meta.Metadata[k] = v
+	}
+
+	return l.writeMeta(objectName, meta)
+}
+
+// AddTags merges tags into a stored file's tags
+func (l *LocalStorage) AddTags(ctx context.Context, objectName string, tags map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	meta, err := l.readMeta(objectName)
+	if err != nil {
+		return err
+	}
+	if meta.Tags == nil {
+		meta.Tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		meta.Tags[k] = v
+	}
+
+	return l.writeMeta(objectName, meta)
+}
+
+// MoveFile renames a stored file together with its attributes
+func (l *LocalStorage) MoveFile(ctx context.Context, objectName, newName string) error {
+	src, err := l.filePath(objectName)
+	if err != nil {
+		return err
+	}
+	dst, err := l.filePath(newName)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	meta, err := l.readMeta(objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move file: %w", err)
+	}
+	if err := l.writeMeta(newName, meta); err != nil {
+		return err
+	}
+
+	metaPath, _ := l.metaPath(objectName)
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove file attributes: %w", err)
+	}
+
+	return nil
+}
+
+// ObjectExists reports whether a file is stored under the given name
+func (l *LocalStorage) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+	return true, nil
+}
+
+// ServeHTTP serves stored files to requests carrying a valid, unexpired link signature
+func (l *LocalStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	objectName := strings.TrimPrefix(r.URL.Path, "/")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		http.Error(w, "link expired", http.StatusForbidden)
+		return
+	}
+	if !hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(l.sign(objectName, expires))) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	filePath, err := l.filePath(objectName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	meta, err := l.readMeta(objectName)
+	if err == nil && meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if err == nil && meta.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", meta.ContentEncoding)
+	}
+
+	http.ServeContent(w, r, path.Base(objectName), stat.ModTime(), file)
+}
+
+// Serve runs the built-in file server until the context is cancelled
+func (l *LocalStorage) Serve(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              l.Addr,
+		Handler:           l,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving local storage %s on %s\n", l.Root, l.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("file server failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+func newTestLocalStorage(t *testing.T) *LocalStorage {
+	t.Helper()
+
+	l, err := NewLocalStorage(config.Config{
+		LocalStorageDir: t.TempDir(),
+		LocalStorageURL: "http://files.example/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	l := newTestLocalStorage(t)
+	ctx := context.Background()
+	data := "hello from the local backend"
+
+	_, err := l.UploadFile(ctx, "42/photo/a b.txt", strings.NewReader(data), int64(len(data)), UploadOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"message-id": "7"},
+		Tags:        map[string]string{"media-type": "photo"},
+	})
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	reader, err := l.DownloadFile(ctx, "42/photo/a b.txt")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	got, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(got) != data {
+		t.Errorf("downloaded %q, want %q", got, data)
+	}
+
+	info, err := l.GetObjectInfo(ctx, "42/photo/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || info.ContentType != "text/plain" {
+		t.Errorf("info has size %d and type %q", info.Size, info.ContentType)
+	}
+	if info.UserMetadata["Message-Id"] != "7" || info.UserMetadata[MetaSHA256] == "" {
+		t.Errorf("metadata is %v", info.UserMetadata)
+	}
+	if info.UserTags["media-type"] != "photo" {
+		t.Errorf("tags are %v", info.UserTags)
+	}
+
+	if err := l.UpdateMetadata(ctx, "42/photo/a b.txt", map[string]string{"deleted": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddTags(ctx, "42/photo/a b.txt", map[string]string{"state": "deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.MoveFile(ctx, "42/photo/a b.txt", "trash/42/photo/a b.txt"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if exists, _ := l.ObjectExists(ctx, "42/photo/a b.txt"); exists {
+		t.Error("moved object still exists under its old name")
+	}
+	info, err = l.GetObjectInfo(ctx, "trash/42/photo/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UserMetadata["Deleted"] != "true" || info.UserMetadata["Message-Id"] != "7" || info.UserTags["state"] != "deleted" || info.UserTags["media-type"] != "photo" {
+		t.Errorf("moved object has metadata %v and tags %v", info.UserMetadata, info.UserTags)
+	}
+
+	objects, err := l.ListFiles(ctx, "trash/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "trash/42/photo/a b.txt" {
+		t.Errorf("listed %v", objects)
+	}
+
+	if err := l.DeleteFile(ctx, "trash/42/photo/a b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := l.ObjectExists(ctx, "trash/42/photo/a b.txt"); exists {
+		t.Error("deleted object still exists")
+	}
+	if err := l.DeleteFile(ctx, "trash/42/photo/a b.txt"); err != nil {
+		t.Errorf("deleting a missing object: %v", err)
+	}
+}
+
+func TestLocalStorageRejectsAttributeNames(t *testing.T) {
+	l := newTestLocalStorage(t)
+	for _, name := range []string{"", "/", localMetaDir, localMetaDir + "/x.json", "../" + localMetaDir + "/x.json"} {
+		if _, err := l.UploadFile(context.Background(), name, strings.NewReader("x"), 1, UploadOptions{}); err == nil {
+			t.Errorf("upload to %q succeeded", name)
+		}
+	}
+}
+
+func TestLocalStorageLinks(t *testing.T) {
+	l := newTestLocalStorage(t)
+	ctx := context.Background()
+	data := "linked file"
+	if _, err := l.UploadFile(ctx, "1/document/a b.txt", strings.NewReader(data), int64(len(data)), UploadOptions{ContentType: "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.UploadFile(ctx, "1/document/other.txt", strings.NewReader("other"), 5, UploadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(link string) *httptest.ResponseRecorder {
+		t.Helper()
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		l.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		return rec
+	}
+	link := func(objectName string, expiry time.Duration) string {
+		t.Helper()
+		link, err := l.GetFileURL(ctx, objectName, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	valid := link("1/document/a b.txt", time.Hour)
+	if !strings.HasPrefix(valid, "http://files.example/1/document/a%20b.txt?") {
+		t.Errorf("link %s does not use the base URL and escaped name", valid)
+	}
+	rec := get(valid)
+	if rec.Code != http.StatusOK || rec.Body.String() != data {
+		t.Fatalf("valid link returned %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("served with content type %q", ct)
+	}
+
+	if rec := get(link("1/document/a b.txt", -time.Minute)); rec.Code != http.StatusForbidden {
+		t.Errorf("expired link returned %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	u, _ := url.Parse(valid)
+	signature := u.Query().Get("signature")
+
+	tests := []struct {
+		name   string
+		modify func(q url.Values, u *url.URL)
+	}{
+		{"tampered signature", func(q url.Values, u *url.URL) {
+			q.Set("signature", strings.Repeat("0", len(signature)))
+		}},
+		{"extended expiry", func(q url.Values, u *url.URL) {
+			q.Set("expires", "99999999999")
+		}},
+		{"missing signature", func(q url.Values, u *url.URL) {
+			q.Del("signature")
+		}},
+		{"signature of another object", func(q url.Values, u *url.URL) {
+			u.Path = "/1/document/other.txt"
+		}},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(valid)
+		q := u.Query()
+		tt.modify(q, u)
+		u.RawQuery = q.Encode()
+		rec := get(u.String())
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: link returned %d, want %d", tt.name, rec.Code, http.StatusForbidden)
+		}
+	}
+
+	// Links are only valid with the secret they were signed with
+	l.secret = []byte("configured secret")
+	if rec := get(valid); rec.Code != http.StatusForbidden {
+		t.Errorf("link signed with another secret returned %d", rec.Code)
+	}
+	if rec := get(link("1/document/a b.txt", time.Hour)); rec.Code != http.StatusOK {
+		t.Errorf("link signed with the new secret returned %d", rec.Code)
+	}
+}
@@ -2,25 +2,52 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
 )
 
 // MinioClient represents a MinIO client instance
 type MinioClient struct {
 	Client     *minio.Client
 	BucketName string
+
+	// SSE holds the customer key objects are encrypted with server-side (SSE-C)
+	SSE encrypt.ServerSide
+
+	// Uploads records the progress of large uploads so they can be resumed
+	Uploads *index.Index
+
+	// Multipart holds the part size and concurrency settings of large uploads
+	Multipart *Multipart
+
+	// Batch sends small uploads together when batching is enabled
+	Batch *Batcher
+
+	objectLocking bool
+}
+
+// UploadOptions holds optional attributes stored alongside an uploaded object
+type UploadOptions struct {
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+	Tags            map[string]string
 }
 
 // NewMinio initializes a new MinIO client
-func NewMinio(cfg config.Config) (*MinioClient, error) {
+func NewMinio(cfg config.Config, multipart *Multipart) (*MinioClient, error) {
 	// Validate MinIO configuration
 	if cfg.MinioHost == "" || cfg.MinioAccessKey == "" || cfg.MinioSecretKey == "" || cfg.MinioBucket == "" {
 		return nil, fmt.Errorf("missing required MinIO configuration")
@@ -37,52 +64,163 @@ func NewMinio(cfg config.Config) (*MinioClient, error) {
 		endpoint = cfg.MinioEndpoint
 	}
 
+	client, err := newMinioClient(config.StorageTarget{
+		Name:      "primary",
+		Endpoint:  endpoint,
+		AccessKey: cfg.MinioAccessKey,
+		SecretKey: cfg.MinioSecretKey,
+		Bucket:    cfg.MinioBucket,
+		SSL:       cfg.MinioSSL,
+		Region:    cfg.MinioRegion,
+		Mode:      config.TargetRequired,
+
+		ObjectLocking: cfg.BucketPolicy.ObjectLockMode != "",
+	}, multipart)
+	if err != nil {
+		return nil, err
+	}
+
+	// MinIO being down only fails startup when degraded mode is off
+	if err := client.EnsureBucket(context.Background()); err != nil {
+		if !cfg.DegradedStartup || !IsUnavailable(err) {
+			return nil, err
+		}
+		fmt.Println("MinIO is unavailable, starting in degraded mode:", err)
+	}
+
+	// Let the server encrypt objects with our key
+	client.SSE, err = serverSideKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snowball archives cannot carry a customer key per object
+	if cfg.BatchUploads && client.SSE == nil {
+		// Uploads wait for their batch, so by default a batch holds one file per worker
+		maxObjects := cfg.BatchMaxObjects
+		if maxObjects == 0 {
+			maxObjects = cfg.WorkerPoolSize()
+		}
+		client.Batch = NewBatcher(client, cfg.BatchWindow, cfg.BatchMaxSize, maxObjects)
+	}
+
+	return client, nil
+}
+
+// serverSideKey returns the customer key for SSE-C, or nil when SSE-C is off
+func serverSideKey(cfg config.Config) (encrypt.ServerSide, error) {
+	if cfg.Encryption != config.EncryptionSSEC {
+		return nil, nil
+	}
+
+	key, err := ParseKey(cfg.EncryptionMasterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENCRYPTION_MASTER_KEY: %w", err)
+	}
+	sse, err := encrypt.NewSSEC(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure SSE-C: %w", err)
+	}
+	return sse, nil
+}
+
+// NewMinioTarget initializes a MinIO client for an S3-compatible storage
+// target without contacting it; EnsureBucket has to succeed before it is used.
+// Objects are encrypted with sse when it is set.
+func NewMinioTarget(target config.StorageTarget, multipart *Multipart, sse encrypt.ServerSide) (*MinioClient, error) {
+	client, err := newMinioClient(target, multipart)
+	if err != nil {
+		return nil, err
+	}
+	client.SSE = sse
+	return client, nil
+}
+
+// newMinioClient creates a MinIO client without contacting the server
+func newMinioClient(target config.StorageTarget, multipart *Multipart) (*MinioClient, error) {
+	if target.Endpoint == "" || target.AccessKey == "" || target.SecretKey == "" || target.Bucket == "" {
+		return nil, fmt.Errorf("missing required configuration for storage target %q", target.Name)
+	}
+
 	// Create MinIO client
-	client, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.MinioAccessKey, cfg.MinioSecretKey, ""),
-		Secure: cfg.MinioSSL,
-		Region: cfg.MinioRegion,
+	client, err := minio.New(target.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(target.AccessKey, target.SecretKey, ""),
+		Secure: target.SSL,
+		Region: target.Region,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MinIO client: %w", err)
 	}
 
 	// Create MinioClient instance
-	minioClient := &MinioClient{
-		Client:     client,
-		BucketName: cfg.MinioBucket,
+	if multipart == nil {
+		multipart = NewMultipart(config.Config{})
 	}
+	return &MinioClient{
+		Client:        client,
+		BucketName:    target.Bucket,
+		Multipart:     multipart,
+		objectLocking: target.ObjectLocking,
+	}, nil
+}
 
-	// Ensure bucket exists
-	ctx := context.Background()
-	exists, err := client.BucketExists(ctx, cfg.MinioBucket)
+// EnsureBucket creates the bucket if it does not exist yet
+func (m *MinioClient) EnsureBucket(ctx context.Context) error {
+	exists, err := m.Client.BucketExists(ctx, m.BucketName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check if bucket exists: %w", err)
+		return fmt.Errorf("failed to check if bucket exists: %w", err)
 	}
 
 	if !exists {
-		err = client.MakeBucket(ctx, cfg.MinioBucket, minio.MakeBucketOptions{})
+		err = m.Client.MakeBucket(ctx, m.BucketName, minio.MakeBucketOptions{ObjectLocking: m.objectLocking})
 		if err != nil {
-			return nil, fmt.Errorf("failed to create bucket: %w", err)
+			return fmt.Errorf("failed to create bucket: %w", err)
 		}
 	}
 
-	return minioClient, nil
+	return nil
 }
 
-// UploadFile uploads a file to MinIO
-func (m *MinioClient) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error) {
-	// For large files (> 50MB), use multipart upload
-	if size > 50*1024*1024 {
-		return m.uploadLargeFile(ctx, objectName, reader, size, contentType)
+// UploadFile uploads a file to MinIO. The upload is verified against the
+// SHA-256 and CRC32C of the data sent and retried when it does not match.
+func (m *MinioClient) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	// Retries need to read the data again
+	body, cleanup, err := replayable(reader)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
 	}
 
-	// For smaller files, use regular upload
-	_, err := m.Client.PutObject(ctx, m.BucketName, objectName, reader, size, minio.PutObjectOptions{
-		ContentType: contentType,
-	})
+	// The digest is stored with the object, so it is computed up front
+	// unless a layer above already did while spooling or compressing
+	sum, err := bodySHA256(body, start)
 	if err != nil {
-		return "", fmt.Errorf("failed to upload file: %w", err)
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+	metadata := make(map[string]string, len(opts.Metadata)+1)
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaSHA256] = sum
+	opts.Metadata = metadata
+
+	for attempt := 1; ; attempt++ {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return "", fmt.Errorf("failed to rewind upload: %w", err)
+		}
+
+		err = m.putVerified(ctx, objectName, body, size, sum, opts)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrChecksumMismatch) || attempt == uploadAttempts {
+			return "", err
+		}
+		fmt.Printf("Upload of %s failed verification, retrying (%d/%d): %v\n", objectName, attempt, uploadAttempts, err)
 	}
 
 	// Generate a presigned URL for the uploaded object
@@ -94,28 +232,77 @@ func (m *MinioClient) UploadFile(ctx context.Context, objectName string, reader
 	return presignedURL, nil
 }
 
-// uploadLargeFile handles large file uploads using concurrent multipart upload
-func (m *MinioClient) uploadLargeFile(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) (string, error) {
-	// Use PutObject with optimized settings for large files
-	opts := minio.PutObjectOptions{
-		ContentType: contentType,
-		// Set part size to 5MB for better performance
-		PartSize: 5 * 1024 * 1024,
+// putVerified uploads a file while hashing it and checks the stored object
+// against the hashes, removing it when they do not match
+func (m *MinioClient) putVerified(ctx context.Context, objectName string, reader io.Reader, size int64, sum string, opts UploadOptions) error {
+	putOpts := minio.PutObjectOptions{
+		ContentType:     opts.ContentType,
+		ContentEncoding: opts.ContentEncoding,
+		UserMetadata:    opts.Metadata,
+		UserTags:        opts.Tags,
+
+		ServerSideEncryption: m.SSE,
+		// Let the server verify a CRC32C of the whole object, also for multipart uploads
+		AutoChecksum: minio.ChecksumFullObjectCRC32C,
 	}
 
-	// Upload the file
-	_, err := m.Client.PutObject(ctx, m.BucketName, objectName, reader, size, opts)
+	digest := newDigestReader(reader)
+	var err error
+	switch {
+	case m.Batch != nil && m.Batch.accepts(size):
+		var data []byte
+		data, err = io.ReadAll(digest)
+		if err == nil {
+			err = m.Batch.Put(ctx, objectName, data, putOpts)
+		}
+	case size <= m.Multipart.Threshold:
+		_, err = m.Client.PutObject(ctx, m.BucketName, objectName, digest, size, putOpts)
+	case m.Uploads != nil:
+		err = m.putResumable(ctx, objectName, digest, size, sum, putOpts)
+	default:
+		err = m.putMultipart(ctx, objectName, digest, size, putOpts)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to upload large file: %w", err)
+		return fmt.Errorf("failed to upload file: %w", err)
 	}
 
-	// Generate a presigned URL for the uploaded object
-	presignedURL, err := m.GetFileURL(ctx, objectName, time.Hour*24*7) // URL valid for 7 days
+	if err := m.verifyUpload(ctx, objectName, digest, size, sum); err != nil {
+		// Never leave a corrupt object behind
+		if removeErr := m.DeleteFile(ctx, objectName); removeErr != nil {
+			fmt.Printf("Error removing corrupt upload %s: %v\n", objectName, removeErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// verifyUpload compares the stored object with the data that was streamed
+func (m *MinioClient) verifyUpload(ctx context.Context, objectName string, digest *digestReader, size int64, sum string) error {
+	if digest.SHA256() != sum {
+		return fmt.Errorf("%w: file changed while uploading %s", ErrChecksumMismatch, objectName)
+	}
+	if size >= 0 && digest.Size() != size {
+		return fmt.Errorf("%w: sent %d of %d bytes of %s", ErrChecksumMismatch, digest.Size(), size, objectName)
+	}
+
+	info, err := m.Client.StatObject(ctx, m.BucketName, objectName, minio.StatObjectOptions{
+		ServerSideEncryption: m.SSE,
+		Checksum:             true,
+	})
 	if err != nil {
-		return "", fmt.Errorf("file uploaded but failed to generate URL: %w", err)
+		return fmt.Errorf("failed to verify upload: %w", err)
+	}
+	if info.Size != digest.Size() {
+		return fmt.Errorf("%w: %s is %d bytes, sent %d", ErrChecksumMismatch, objectName, info.Size, digest.Size())
 	}
 
-	return presignedURL, nil
+	// Composite checksums of multipart uploads ("...-N") cannot be compared
+	if stored := info.ChecksumCRC32C; stored != "" && !strings.Contains(stored, "-") && stored != digest.CRC32C() {
+		return fmt.Errorf("%w: %s has CRC32C %s, sent %s", ErrChecksumMismatch, objectName, stored, digest.CRC32C())
+	}
+
+	return nil
 }
 
 // GetFileURL generates a presigned URL for accessing a file
@@ -133,7 +320,7 @@ func (m *MinioClient) GetFileURL(ctx context.Context, objectName string, expiry
 // DownloadFile downloads a file from MinIO
 func (m *MinioClient) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
 	// Get object
-	object, err := m.Client.GetObject(ctx, m.BucketName, objectName, minio.GetObjectOptions{})
+	object, err := m.Client.GetObject(ctx, m.BucketName, objectName, minio.GetObjectOptions{ServerSideEncryption: m.SSE})
 	if err != nil {
 		return nil, fmt.Errorf("failed to download file: %w", err)
 	}
@@ -142,8 +329,8 @@ func (m *MinioClient) DownloadFile(ctx context.Context, objectName string) (io.R
 }
 
 // ListFiles lists all files in the bucket with an optional prefix
-func (m *MinioClient) ListFiles(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
-	var objects []minio.ObjectInfo
+func (m *MinioClient) ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
 
 	// Create a channel to receive objects
 	objectCh := m.Client.ListObjects(ctx, m.BucketName, minio.ListObjectsOptions{
@@ -173,15 +360,118 @@ func (m *MinioClient) DeleteFile(ctx context.Context, objectName string) error {
 }
 
 // GetObjectInfo gets information about an object
-func (m *MinioClient) GetObjectInfo(ctx context.Context, objectName string) (minio.ObjectInfo, error) {
-	info, err := m.Client.StatObject(ctx, m.BucketName, objectName, minio.StatObjectOptions{})
+func (m *MinioClient) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	info, err := m.Client.StatObject(ctx, m.BucketName, objectName, minio.StatObjectOptions{ServerSideEncryption: m.SSE})
 	if err != nil {
-		return minio.ObjectInfo{}, fmt.Errorf("failed to get object info: %w", err)
+		return ObjectInfo{}, fmt.Errorf("failed to get object info: %w", err)
+	}
+
+	// A HEAD request only returns the number of tags
+	if info.UserTagCount > 0 && len(info.UserTags) == 0 {
+		tags, err := m.Client.GetObjectTagging(ctx, m.BucketName, objectName, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("failed to get object tags: %w", err)
+		}
+		info.UserTags = tags.ToMap()
 	}
 
 	return info, nil
 }
 
+// UpdateMetadata merges metadata into an existing object's user metadata
+func (m *MinioClient) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	info, err := m.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return err
+	}
+
+	// Metadata can only be replaced as a whole, so start from the current set
+	merged := make(map[string]string, len(info.UserMetadata)+len(metadata)+1)
+	for k, v := range info.UserMetadata {
+		merged[k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged["Content-Type"] = info.ContentType
+	if encoding := info.Metadata.Get("Content-Encoding"); encoding != "" {
+		merged["Content-Encoding"] = encoding
+	}
+
+	_, err = m.Client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:          m.BucketName,
+		Object:          objectName,
+		UserMetadata:    merged,
+		ReplaceMetadata: true,
+		Encryption:      m.SSE,
+	}, minio.CopySrcOptions{
+		Bucket:     m.BucketName,
+		Object:     objectName,
+		Encryption: m.SSE,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update metadata: %w", err)
+	}
+
+	return nil
+}
+
+// AddTags merges tags into an object's existing tags
+func (m *MinioClient) AddTags(ctx context.Context, objectName string, newTags map[string]string) error {
+	current, err := m.Client.GetObjectTagging(ctx, m.BucketName, objectName, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get object tags: %w", err)
+	}
+
+	merged := current.ToMap()
+	for k, v := range newTags {
+		merged[k] = v
+	}
+
+	objectTags, err := tags.NewTags(merged, true)
+	if err != nil {
+		return fmt.Errorf("invalid object tags: %w", err)
+	}
+
+	err = m.Client.PutObjectTagging(ctx, m.BucketName, objectName, objectTags, minio.PutObjectTaggingOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to set object tags: %w", err)
+	}
+
+	return nil
+}
+
+// MoveFile moves an object to a new name within the bucket
+func (m *MinioClient) MoveFile(ctx context.Context, objectName, newName string) error {
+	_, err := m.Client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:     m.BucketName,
+		Object:     newName,
+		Encryption: m.SSE,
+	}, minio.CopySrcOptions{
+		Bucket:     m.BucketName,
+		Object:     objectName,
+		Encryption: m.SSE,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+
+	return m.DeleteFile(ctx, objectName)
+}
+
+// ObjectExists reports whether an object exists in the bucket
+func (m *MinioClient) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	_, err := m.Client.StatObject(ctx, m.BucketName, objectName, minio.StatObjectOptions{ServerSideEncryption: m.SSE})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check object: %w", err)
+	}
+
+	return true, nil
+}
+
 // GenerateObjectName generates a unique object name based on the original filename
 func (m *MinioClient) GenerateObjectName(originalFilename string) string {
 	// Extract file extension
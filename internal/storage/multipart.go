@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+)
+
+// S3 limits on multipart uploads
+const (
+	minPartSize = 5 * 1024 * 1024
+	maxPartSize = 5 * 1024 * 1024 * 1024
+	maxParts    = 10000
+)
+
+// Part sizes aim at targetParts parts, but do not grow past preferredMaxPartSize
+// unless the file would need more than maxParts parts
+const (
+	targetParts          = 200
+	preferredMaxPartSize = 64 * 1024 * 1024
+)
+
+// Multipart holds the multipart upload settings shared by all MinIO clients
+type Multipart struct {
+	// Threshold is the size above which files are uploaded in parts
+	Threshold int64
+	// Threads is how many parts of a file are uploaded at once
+	Threads int
+	// Buffers bounds the memory used for part buffers across all uploads
+	Buffers *BufferPool
+}
+
+// NewMultipart creates the multipart settings from the configuration
+func NewMultipart(cfg config.Config) *Multipart {
+	multipart := &Multipart{
+		Threshold: cfg.MultipartThreshold,
+		Threads:   cfg.UploadThreads,
+	}
+	if multipart.Threshold < minPartSize {
+		multipart.Threshold = 50 * 1024 * 1024
+	}
+	if multipart.Threads <= 0 {
+		multipart.Threads = 4
+	}
+
+	memory := cfg.UploadBufferMemory
+	if memory <= 0 {
+		memory = 256 * 1024 * 1024
+	}
+	multipart.Buffers = NewBufferPool(memory)
+
+	return multipart
+}
+
+// partSize picks the part size for a file, staying within the part limit
+func partSize(size int64) int64 {
+	n := (size + targetParts - 1) / targetParts
+	n = max(minPartSize, min(n, preferredMaxPartSize))
+	if need := (size + maxParts - 1) / maxParts; n < need {
+		n = need
+	}
+
+	// Round up to whole MiB
+	const mib = 1024 * 1024
+	n = (n + mib - 1) / mib * mib
+	return min(n, maxPartSize)
+}
+
+// threads returns how many parts of a size can be uploaded at once within the memory budget
+func (mp *Multipart) threads(partSize int64) int {
+	return int(max(1, min(int64(mp.Threads), mp.Buffers.limit/partSize)))
+}
+
+// putMultipart uploads a large file in parallel parts without recording progress
+func (m *MinioClient) putMultipart(ctx context.Context, objectName string, reader io.Reader, size int64, opts minio.PutObjectOptions) error {
+	partSize := partSize(size)
+	threads := m.Multipart.threads(partSize)
+	opts.PartSize = uint64(partSize)
+	opts.NumThreads = uint(threads)
+	opts.ConcurrentStreamParts = true
+
+	// The client allocates a buffer per thread, which counts against the shared budget
+	release, err := m.Multipart.Buffers.Reserve(ctx, int64(threads)*partSize)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = m.Client.PutObject(ctx, m.BucketName, objectName, reader, size, opts)
+	return err
+}
+
+// putResumable uploads a large file part by part and records every stored
+// part, so an interrupted upload continues where it stopped
+func (m *MinioClient) putResumable(ctx context.Context, objectName string, reader io.Reader, size int64, sum string, opts minio.PutObjectOptions) error {
+	core := minio.Core{Client: m.Client}
+	partSize := partSize(size)
+
+	upload, err := m.resumeUpload(ctx, core, objectName, size, sum, partSize)
+	if err != nil {
+		return err
+	}
+	if upload.UploadID == "" {
+		// Parts are checked against their MD5 instead of a whole-object checksum
+		opts.AutoChecksum = minio.ChecksumNone
+		uploadID, err := core.NewMultipartUpload(ctx, m.BucketName, objectName, opts)
+		if err != nil {
+			return fmt.Errorf("failed to start upload: %w", err)
+		}
+		upload = index.Upload{
+			Bucket:   m.BucketName,
+			Key:      objectName,
+			UploadID: uploadID,
+			SHA256:   sum,
+			Size:     size,
+			PartSize: partSize,
+			Started:  time.Now(),
+		}
+	}
+
+	stored := map[int]index.UploadPart{}
+	for _, p := range upload.Parts {
+		stored[p.Number] = p
+	}
+	upload.Parts = nil
+	uploadID := upload.UploadID
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	// record adds a stored part to the upload and persists the progress
+	record := func(part index.UploadPart) {
+		mu.Lock()
+		defer mu.Unlock()
+		upload.Parts = append(upload.Parts, part)
+		upload.Updated = time.Now()
+		if err := m.Uploads.PutUpload(upload); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to record upload progress: %w", err)
+			cancel()
+		}
+	}
+
+	// Parts are read in order and uploaded by up to threads workers
+	slots := make(chan struct{}, m.Multipart.threads(partSize))
+	resumed := 0
+read:
+	for number := 1; ; number++ {
+		buf, err := m.Multipart.Buffers.Get(ctx, int(partSize))
+		if err != nil {
+			fail(err)
+			break
+		}
+		n, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			m.Multipart.Buffers.Put(buf)
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			m.Multipart.Buffers.Put(buf)
+			fail(fmt.Errorf("failed to read upload: %w", err))
+			break
+		}
+		data := buf[:n]
+		digest := md5.Sum(data)
+		part := index.UploadPart{Number: number, MD5: hex.EncodeToString(digest[:]), Size: int64(n)}
+
+		// Parts already in the bucket are kept when they hold the same data
+		if p, ok := stored[number]; ok && p.MD5 == part.MD5 && p.Size == part.Size {
+			m.Multipart.Buffers.Put(buf)
+			part.ETag = p.ETag
+			resumed++
+			record(part)
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			m.Multipart.Buffers.Put(buf)
+			break read
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				m.Multipart.Buffers.Put(buf)
+				<-slots
+				wg.Done()
+			}()
+
+			etag, err := m.putPart(ctx, core, objectName, uploadID, part.Number, data, base64.StdEncoding.EncodeToString(digest[:]))
+			if err != nil {
+				fail(err)
+				return
+			}
+			part.ETag = etag
+			record(part)
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(upload.Parts, func(i, j int) bool { return upload.Parts[i].Number < upload.Parts[j].Number })
+	complete := make([]minio.CompletePart, len(upload.Parts))
+	for i, p := range upload.Parts {
+		complete[i] = minio.CompletePart{PartNumber: p.Number, ETag: p.ETag}
+	}
+	if resumed > 0 {
+		fmt.Printf("Resumed upload of %s, %d of %d parts were already stored\n", objectName, resumed, len(complete))
+	}
+
+	_, err = core.CompleteMultipartUpload(ctx, m.BucketName, objectName, uploadID, complete, minio.PutObjectOptions{
+		ServerSideEncryption: m.SSE,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete upload: %w", err)
+	}
+	if err := m.Uploads.DeleteUpload(m.BucketName, objectName); err != nil {
+		fmt.Printf("Error forgetting completed upload of %s: %v\n", objectName, err)
+	}
+
+	return nil
+}
+
+// putPart uploads a single part, retrying transient failures, and returns its ETag
+func (m *MinioClient) putPart(ctx context.Context, core minio.Core, objectName, uploadID string, number int, data []byte, md5Base64 string) (string, error) {
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		var part minio.ObjectPart
+		part, err = core.PutObjectPart(ctx, m.BucketName, objectName, uploadID, number, bytes.NewReader(data), int64(len(data)), minio.PutObjectPartOptions{
+			Md5Base64: md5Base64,
+			SSE:       m.SSE,
+		})
+		if err == nil {
+			return trimETag(part.ETag), nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("Error uploading part %d of %s (%d/%d): %v\n", number, objectName, attempt, uploadAttempts, err)
+	}
+	return "", fmt.Errorf("failed to upload part %d: %w", number, err)
+}
+
+// resumeUpload returns the recorded upload of an object, keeping only the
+// parts that are still stored in the bucket. An empty upload means starting over.
+func (m *MinioClient) resumeUpload(ctx context.Context, core minio.Core, objectName string, size int64, sum string, partSize int64) (index.Upload, error) {
+	upload, found, err := m.Uploads.GetUpload(m.BucketName, objectName)
+	if err != nil {
+		return index.Upload{}, fmt.Errorf("failed to read upload progress: %w", err)
+	}
+	if !found {
+		return index.Upload{}, nil
+	}
+
+	// A different file under the same name starts over. The digest covers the
+	// bytes sent, so with client-side encryption, which uses a fresh data key
+	// and nonce for every attempt, an interrupted upload always starts over.
+	if upload.SHA256 != sum || upload.Size != size || upload.PartSize != partSize {
+		m.abortUpload(ctx, upload)
+		return index.Upload{}, nil
+	}
+
+	parts, err := m.listParts(ctx, core, upload)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+			m.forgetUpload(upload)
+			return index.Upload{}, nil
+		}
+		return index.Upload{}, fmt.Errorf("failed to list uploaded parts: %w", err)
+	}
+
+	var kept []index.UploadPart
+	for _, p := range upload.Parts {
+		if s, ok := parts[p.Number]; ok && trimETag(s.ETag) == p.ETag && s.Size == p.Size {
+			kept = append(kept, p)
+		}
+	}
+	upload.Parts = kept
+	return upload, nil
+}
+
+// listParts returns the parts of an upload stored in the bucket by number
+func (m *MinioClient) listParts(ctx context.Context, core minio.Core, upload index.Upload) (map[int]minio.ObjectPart, error) {
+	parts := map[int]minio.ObjectPart{}
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(ctx, m.BucketName, upload.Key, upload.UploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range result.ObjectParts {
+			parts[p.PartNumber] = p
+		}
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// abortUpload removes the stored parts of an upload and forgets it
+func (m *MinioClient) abortUpload(ctx context.Context, upload index.Upload) error {
+	core := minio.Core{Client: m.Client}
+	err := core.AbortMultipartUpload(ctx, m.BucketName, upload.Key, upload.UploadID)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+		return fmt.Errorf("failed to abort upload of %s: %w", upload.Key, err)
+	}
+	m.forgetUpload(upload)
+	return nil
+}
+
+// forgetUpload removes the recorded progress of an upload
+func (m *MinioClient) forgetUpload(upload index.Upload) {
+	if err := m.Uploads.DeleteUpload(upload.Bucket, upload.Key); err != nil {
+		fmt.Printf("Error forgetting upload of %s: %v\n", upload.Key, err)
+	}
+}
+
+// CleanupUploads aborts the bot's incomplete uploads that made no progress
+// for longer than staleAfter. Progress made before since counts as made at
+// since, so uploads interrupted by downtime get a chance to resume.
+func (m *MinioClient) CleanupUploads(ctx context.Context, staleAfter time.Duration, since time.Time) error {
+	if m.Uploads == nil {
+		return nil
+	}
+
+	uploads, err := m.Uploads.Uploads(m.BucketName)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, upload := range uploads {
+		last := upload.Updated
+		if last.IsZero() {
+			last = upload.Started
+		}
+		if time.Since(latest(last, since)) < staleAfter {
+			continue
+		}
+
+		if err := m.abortUpload(ctx, upload); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Aborted stale upload of %s, last progress %s\n", upload.Key, last.Format(time.RFC3339))
+	}
+	return errors.Join(errs...)
+}
+
+// RunCleanup aborts stale uploads every interval until the context is cancelled.
+// Staleness is measured from startup at the earliest.
+func (m *MinioClient) RunCleanup(ctx context.Context, interval, staleAfter time.Duration) {
+	started := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.CleanupUploads(ctx, staleAfter, started); err != nil {
+			fmt.Println("Error cleaning up stale uploads:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// latest returns the later of two times
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// trimETag removes the quotes S3 puts around ETags
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/index"
+)
+
+const mib = 1024 * 1024
+
+func TestPartSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		want int64
+	}{
+		{"empty file", 0, minPartSize},
+		{"small file uses the minimum", 10 * mib, minPartSize},
+		{"200 minimum parts", targetParts * minPartSize, minPartSize},
+		{"just over 200 minimum parts", targetParts*minPartSize + 1, 6 * mib},
+		{"200 parts of 10 MiB", targetParts * 10 * mib, 10 * mib},
+		{"rounded up to whole MiB", targetParts*10*mib + targetParts, 11 * mib},
+		{"capped at 64 MiB", targetParts * 100 * mib, preferredMaxPartSize},
+		{"10,000 parts of 64 MiB", maxParts * preferredMaxPartSize, preferredMaxPartSize},
+		{"grows past 64 MiB beyond 10,000 parts", maxParts*preferredMaxPartSize + 1, 65 * mib},
+		{"5 TiB", 5 * 1024 * 1024 * mib, 525 * mib},
+		{"capped at 5 GiB", maxParts * maxPartSize * 2, maxPartSize},
+	}
+	for _, tt := range tests {
+		got := partSize(tt.size)
+		if got != tt.want {
+			t.Errorf("%s: partSize(%d) = %d, want %d", tt.name, tt.size, got, tt.want)
+		}
+		if got%mib != 0 && got != maxPartSize {
+			t.Errorf("%s: part size %d is not a whole number of MiB", tt.name, got)
+		}
+		if got < maxPartSize && (tt.size+got-1)/got > maxParts {
+			t.Errorf("%s: %d bytes need more than %d parts of %d", tt.name, tt.size, maxParts, got)
+		}
+	}
+}
+
+// fakeS3 serves the multipart upload calls of a single bucket
+type fakeS3 struct {
+	mu       sync.Mutex
+	nextID   int
+	uploads  map[string]map[int][]byte
+	objects  map[string][]byte
+	sent     []int
+	aborted  []string
+	mangled  map[int]bool
+	complete []int
+	// failPart is refused, like a connection that drops
+	failPart int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		uploads: map[string]map[int][]byte{},
+		objects: map[string][]byte{},
+		mangled: map[int]bool{},
+	}
+}
+
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.noSuchUpload(w)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>refused</Message></Error>")
+			return
+		}
+		data, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		parts[number] = data
+		f.sent = append(f.sent, number)
+		w.Header().Set("ETag", `"`+partETag(data)+`"`)
+
+	case r.Method == http.MethodGet && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.noSuchUpload(w)
+			return
+		}
+		var body bytes.Buffer
+		body.WriteString("<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for number, data := range parts {
+			etag := partETag(data)
+			if f.mangled[number] {
+				etag = "mangled"
+			}
+			fmt.Fprintf(&body, `<Part><PartNumber>%d</PartNumber><ETag>"%s"</ETag><Size>%d</Size></Part>`, number, etag, len(data))
+		}
+		body.WriteString("</ListPartsResult>")
+		w.Write(body.Bytes())
+
+	case r.Method == http.MethodPost && uploadID != "":
+		parts, ok := f.uploads[uploadID]
+		if !ok {
+			f.noSuchUpload(w)
+			return
+		}
+		var req struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		f.complete = nil
+		for _, p := range req.Parts {
+			data = append(data, parts[p.PartNumber]...)
+			f.complete = append(f.complete, p.PartNumber)
+		}
+		f.objects[r.URL.Path] = data
+		delete(f.uploads, uploadID)
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>object</Key><ETag>"%s"</ETag></CompleteMultipartUploadResult>`, partETag(data))
+
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		f.aborted = append(f.aborted, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+// readPayload reads a request body, decoding the aws-chunked encoding the
+// client uses to sign streamed bodies
+func readPayload(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return body, err
+	}
+
+	var data []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, fmt.Errorf("truncated chunk")
+		}
+		sizeHex, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, rest[:size]...)
+		body = rest[size+2:]
+	}
+}
+
+func (f *fakeS3) noSuchUpload(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, "<Error><Code>NoSuchUpload</Code><Message>no such upload</Message></Error>")
+}
+
+// newTestMultipartClient returns a client uploading to a fake S3 bucket
+func newTestMultipartClient(t *testing.T) (*MinioClient, *fakeS3) {
+	t.Helper()
+
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(server.Listener.Addr().String(), &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &MinioClient{
+		Client:     client,
+		BucketName: "bucket",
+		Multipart:  NewMultipart(config.Config{}),
+		Uploads:    idx,
+	}, fake
+}
+
+// testUploadData returns data of three parts, the last one shorter
+func testUploadData() []byte {
+	data := make([]byte, 2*minPartSize+1234)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// recordParts starts an upload in the fake bucket with the given parts stored
+// and records it the way an interrupted upload would have
+func recordParts(t *testing.T, m *MinioClient, fake *fakeS3, data []byte, sum string, numbers ...int) index.Upload {
+	t.Helper()
+
+	fake.nextID++
+	upload := index.Upload{
+		Bucket:   m.BucketName,
+		Key:      "object",
+		UploadID: fmt.Sprintf("upload-%d", fake.nextID),
+		SHA256:   sum,
+		Size:     int64(len(data)),
+		PartSize: partSize(int64(len(data))),
+	}
+	fake.uploads[upload.UploadID] = map[int][]byte{}
+	for _, number := range numbers {
+		start := int64(number-1) * upload.PartSize
+		part := data[start:min(start+upload.PartSize, int64(len(data)))]
+		fake.uploads[upload.UploadID][number] = part
+		upload.Parts = append(upload.Parts, index.UploadPart{
+			Number: number,
+			ETag:   partETag(part),
+			MD5:    partETag(part),
+			Size:   int64(len(part)),
+		})
+	}
+	if err := m.Uploads.PutUpload(upload); err != nil {
+		t.Fatal(err)
+	}
+	return upload
+}
+
+func TestPutResumable(t *testing.T) {
+	data := testUploadData()
+	sum, _ := sha256Of(bytes.NewReader(data))
+
+	tests := []struct {
+		name string
+		// stored are the parts of the interrupted upload in the bucket
+		stored  []int
+		mangled []int
+		sum     string
+		// sent are the parts expected to be uploaded
+		sent    []int
+		aborted bool
+	}{
+		{name: "new upload", sent: []int{1, 2, 3}},
+		{name: "resumes after the stored parts", stored: []int{1, 2}, sum: sum, sent: []int{3}},
+		{name: "fills a gap", stored: []int{1, 3}, sum: sum, sent: []int{2}},
+		{name: "all parts stored", stored: []int{1, 2, 3}, sum: sum},
+		{name: "part changed in the bucket", stored: []int{1, 2}, mangled: []int{2}, sum: sum, sent: []int{2, 3}},
+		{name: "different file starts over", stored: []int{1, 2}, sum: "other", sent: []int{1, 2, 3}, aborted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fake := newTestMultipartClient(t)
+			if tt.stored != nil {
+				recordParts(t, m, fake, data, tt.sum, tt.stored...)
+			}
+			for _, number := range tt.mangled {
+				fake.mangled[number] = true
+			}
+
+			err := m.putResumable(context.Background(), "object", bytes.NewReader(data), int64(len(data)), sum, minio.PutObjectOptions{})
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+
+			sort.Ints(fake.sent)
+			if fmt.Sprint(fake.sent) != fmt.Sprint(tt.sent) && !(len(fake.sent) == 0 && len(tt.sent) == 0) {
+				t.Errorf("uploaded parts %v, want %v", fake.sent, tt.sent)
+			}
+			if fmt.Sprint(fake.complete) != "[1 2 3]" {
+				t.Errorf("completed with parts %v, want [1 2 3]", fake.complete)
+			}
+			if !bytes.Equal(fake.objects["/bucket/object"], data) {
+				t.Error("stored object differs from the data")
+			}
+			if aborted := len(fake.aborted) > 0; aborted != tt.aborted {
+				t.Errorf("aborted uploads %v, want aborted %v", fake.aborted, tt.aborted)
+			}
+			if _, found, _ := m.Uploads.GetUpload(m.BucketName, "object"); found {
+				t.Error("completed upload is still recorded")
+			}
+		})
+	}
+}
+
+func TestPutResumableRecordsProgress(t *testing.T) {
+	data := testUploadData()
+	sum, _ := sha256Of(bytes.NewReader(data))
+	m, fake := newTestMultipartClient(t)
+
+	// Parts are sent one at a time and the connection drops at the last one
+	m.Multipart.Threads = 1
+	fake.failPart = 3
+	err := m.putResumable(context.Background(), "object", bytes.NewReader(data), int64(len(data)), sum, minio.PutObjectOptions{})
+	if err == nil {
+		t.Fatal("upload with a refused part succeeded")
+	}
+
+	upload, found, err := m.Uploads.GetUpload(m.BucketName, "object")
+	if err != nil || !found {
+		t.Fatalf("interrupted upload is not recorded: %v", err)
+	}
+	var numbers []int
+	for _, p := range upload.Parts {
+		numbers = append(numbers, p.Number)
+	}
+	sort.Ints(numbers)
+	if fmt.Sprint(numbers) != "[1 2]" {
+		t.Errorf("recorded parts %v, want [1 2]", numbers)
+	}
+
+	// The next upload of the same file only sends the missing part
+	fake.sent = nil
+	fake.failPart = 0
+	if err := m.putResumable(context.Background(), "object", bytes.NewReader(data), int64(len(data)), sum, minio.PutObjectOptions{}); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if fmt.Sprint(fake.sent) != "[3]" {
+		t.Errorf("resumed upload sent parts %v, want [3]", fake.sent)
+	}
+	if !bytes.Equal(fake.objects["/bucket/object"], data) {
+		t.Error("stored object differs from the data")
+	}
+}
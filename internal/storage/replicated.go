@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// Target is a storage backend archived files are replicated to
+type Target struct {
+	Name     string
+	Required bool
+	Storage  Storage
+
+	mu     sync.Mutex
+	status TargetStatus
+	// ready is set once the target's bucket is known to exist
+	ready bool
+}
+
+// TargetStatus tracks how writes to a target went
+type TargetStatus struct {
+	Succeeded   int
+	Failed      int
+	Reconciled  int
+	LastSuccess time.Time
+	LastError   string
+}
+
+// record updates the status of a target after a write
+func (t *Target) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.status.Failed++
+		t.status.LastError = err.Error()
+		return
+	}
+	t.status.Succeeded++
+	t.status.LastSuccess = time.Now()
+}
+
+// ensureBucket creates the target's bucket if that was not possible at startup
+func (t *Target) ensureBucket(ctx context.Context) error {
+	t.mu.Lock()
+	ready := t.ready
+	t.mu.Unlock()
+	if ready {
+		return nil
+	}
+
+	if client, ok := t.Storage.(interface{ EnsureBucket(context.Context) error }); ok {
+		if err := client.EnsureBucket(ctx); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.ready = true
+	t.mu.Unlock()
+	return nil
+}
+
+// Status returns a snapshot of the target's status
+func (t *Target) Status() TargetStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Replicated writes every file to a primary backend and fans writes out to
+// additional targets. Reads are served by the primary. Required targets fail
+// the write, best-effort targets are caught up by the reconciler.
+type Replicated struct {
+	Primary  Storage
+	Targets  []*Target
+	Interval time.Duration
+}
+
+// NewReplicated creates a replicated backend for the configured storage
+// targets. With SSE-C the targets are encrypted with the same key as the primary.
+func NewReplicated(primary Storage, cfg config.Config, multipart *Multipart) (*Replicated, error) {
+	interval := cfg.ReplicationInterval
+	if interval <= 0 {
+		interval = 15 * time.Minute
+	}
+
+	sse, err := serverSideKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replicated{Primary: primary, Interval: interval}
+	for _, t := range cfg.StorageTargets {
+		switch t.Mode {
+		case config.TargetRequired, config.TargetBestEffort:
+		default:
+			return nil, fmt.Errorf("unknown mode %q for storage target %q", t.Mode, t.Name)
+		}
+
+		client, err := NewMinioTarget(t, multipart, sse)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize storage target %q: %w", t.Name, err)
+		}
+		target := &Target{
+			Name:     t.Name,
+			Required: t.Mode == config.TargetRequired,
+			Storage:  client,
+		}
+
+		// Best-effort targets are caught up by the reconciler, required ones
+		// only start without their bucket in degraded mode
+		if err := target.ensureBucket(context.Background()); err != nil {
+			if target.Required && (!cfg.DegradedStartup || !IsUnavailable(err)) {
+				return nil, fmt.Errorf("failed to initialize storage target %q: %w", t.Name, err)
+			}
+			fmt.Printf("Storage target %s is unavailable, starting without it: %v\n", t.Name, err)
+			target.record(err)
+		}
+		r.Targets = append(r.Targets, target)
+	}
+
+	return r, nil
+}
+
+// Unwrap returns the primary backend
+func (r *Replicated) Unwrap() Storage {
+	return r.Primary
+}
+
+// fanOut applies a write to every target. Failures of required targets are
+// returned, failures of best-effort targets are only logged.
+func (r *Replicated) fanOut(ctx context.Context, op string, write func(t *Target) error) error {
+	var errs []error
+	for _, t := range r.Targets {
+		err := t.ensureBucket(ctx)
+		if err == nil {
+			err = write(t)
+		}
+		t.record(err)
+		if err == nil {
+			continue
+		}
+		if t.Required {
+			errs = append(errs, fmt.Errorf("storage target %s: %w", t.Name, err))
+			continue
+		}
+		fmt.Printf("Replication of %s to %s failed, leaving it to the reconciler: %v\n", op, t.Name, err)
+	}
+	return errors.Join(errs...)
+}
+
+// UploadFile uploads a file to the primary and then to every target
+func (r *Replicated) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	body, cleanup, err := replayable(reader)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	// Hash once for the primary and every target
+	body, err = withSHA256(body, start)
+	if err != nil {
+		return "", err
+	}
+
+	url, err := r.Primary.UploadFile(ctx, objectName, body, size, opts)
+	if err != nil {
+		return "", err
+	}
+
+	err = r.fanOut(ctx, "upload "+objectName, func(t *Target) error {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind upload: %w", err)
+		}
+		_, err := t.Storage.UploadFile(ctx, objectName, body, size, opts)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
+
+// replayable returns a reader that can be rewound for each target. Readers
+// that cannot seek are spooled to a temporary file and hashed on the way, so
+// the layers below neither spool nor hash them again.
+func replayable(reader io.Reader) (io.ReadSeeker, func(), error) {
+	if rs, ok := reader.(io.ReadSeeker); ok {
+		return rs, func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "teleminio-replica-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), reader); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to spool upload: %w", err)
+	}
+	return &summedBody{ReadSeeker: file, sum: hex.EncodeToString(hash.Sum(nil))}, cleanup, nil
+}
+
+// GetFileURL returns a link to the primary copy of a file
+func (r *Replicated) GetFileURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	return r.Primary.GetFileURL(ctx, objectName, expiry)
+}
+
+// DownloadFile opens the primary copy of a file
+func (r *Replicated) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	return r.Primary.DownloadFile(ctx, objectName)
+}
+
+// ListFiles lists the files stored on the primary
+func (r *Replicated) ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return r.Primary.ListFiles(ctx, prefix)
+}
+
+// GetObjectInfo gets information about the primary copy of a file
+func (r *Replicated) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	return r.Primary.GetObjectInfo(ctx, objectName)
+}
+
+// ObjectExists reports whether a file exists on the primary
+func (r *Replicated) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	return r.Primary.ObjectExists(ctx, objectName)
+}
+
+// DeleteFile deletes a file from the primary and every target
+func (r *Replicated) DeleteFile(ctx context.Context, objectName string) error {
+	if err := r.Primary.DeleteFile(ctx, objectName); err != nil {
+		return err
+	}
+	return r.fanOut(ctx, "delete "+objectName, func(t *Target) error {
+		return t.Storage.DeleteFile(ctx, objectName)
+	})
+}
+
+// UpdateMetadata updates a file's metadata on the primary and every target
+func (r *Replicated) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	if err := r.Primary.UpdateMetadata(ctx, objectName, metadata); err != nil {
+		return err
+	}
+	return r.fanOut(ctx, "metadata of "+objectName, func(t *Target) error {
+		return t.Storage.UpdateMetadata(ctx, objectName, metadata)
+	})
+}
+
+// AddTags adds tags to a file on the primary and every target
+func (r *Replicated) AddTags(ctx context.Context, objectName string, tags map[string]string) error {
+	if err := r.Primary.AddTags(ctx, objectName, tags); err != nil {
+		return err
+	}
+	return r.fanOut(ctx, "tags of "+objectName, func(t *Target) error {
+		return t.Storage.AddTags(ctx, objectName, tags)
+	})
+}
+
+// MoveFile moves a file on the primary and every target
+func (r *Replicated) MoveFile(ctx context.Context, objectName, newName string) error {
+	if err := r.Primary.MoveFile(ctx, objectName, newName); err != nil {
+		return err
+	}
+	return r.fanOut(ctx, "move of "+objectName, func(t *Target) error {
+		return t.Storage.MoveFile(ctx, objectName, newName)
+	})
+}
+
+// Run reconciles the targets periodically until the context is cancelled
+func (r *Replicated) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Reconcile(ctx); err != nil {
+			fmt.Println("Error reconciling storage targets:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile copies objects that exist on the primary but are missing from a target
+func (r *Replicated) Reconcile(ctx context.Context) error {
+	if len(r.Targets) == 0 {
+		return nil
+	}
+
+	objects, err := r.Primary.ListFiles(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, t := range r.Targets {
+		copied, err := r.reconcileTarget(ctx, t, objects)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storage target %s: %w", t.Name, err))
+		}
+
+		status := t.Status()
+		if copied > 0 || err != nil {
+			fmt.Printf("Reconciled %d objects to storage target %s (succeeded: %d, failed: %d)\n", copied, t.Name, status.Succeeded, status.Failed)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reconcileTarget copies the objects missing from a single target
+func (r *Replicated) reconcileTarget(ctx context.Context, t *Target, objects []ObjectInfo) (int, error) {
+	if err := t.ensureBucket(ctx); err != nil {
+		t.record(err)
+		return 0, err
+	}
+
+	existing, err := t.Storage.ListFiles(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, obj := range existing {
+		present[obj.Key] = true
+	}
+
+	copied := 0
+	for _, obj := range objects {
+		if present[obj.Key] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+
+		if err := r.copyTo(ctx, t, obj.Key); err != nil {
+			t.record(err)
+			fmt.Printf("Failed to copy %s to storage target %s: %v\n", obj.Key, t.Name, err)
+			continue
+		}
+
+		t.mu.Lock()
+		t.status.Reconciled++
+		t.mu.Unlock()
+		t.record(nil)
+		copied++
+	}
+
+	return copied, nil
+}
+
+// copyTo copies an object with its metadata and tags from the primary to a target
+func (r *Replicated) copyTo(ctx context.Context, t *Target, objectName string) error {
+	// The info includes the tags, so lifecycle rules also match the copy
+	info, err := r.Primary.GetObjectInfo(ctx, objectName)
+	if err != nil {
+		return err
+	}
+
+	reader, err := r.Primary.DownloadFile(ctx, objectName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = t.Storage.UploadFile(ctx, objectName, reader, info.Size, UploadOptions{
+		ContentType:     info.ContentType,
+		ContentEncoding: info.Metadata.Get("Content-Encoding"),
+		Metadata:        info.UserMetadata,
+		Tags:            info.UserTags,
+	})
+	return err
+}
@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// ErrSpoolFull is returned when a file does not fit into the spool
+var ErrSpoolFull = errors.New("upload spool is full")
+
+// Spooled guards a backend with a circuit breaker. While storage is
+// unavailable uploads are kept in a bounded local spool, which is drained
+// once a probe finds storage working again.
+type Spooled struct {
+	Storage
+	Breaker *Breaker
+	Dir     string
+	MaxSize int64
+	// Probe checks whether storage recovered while the breaker is half-open
+	Probe func(ctx context.Context) error
+	// Recovered finishes setup that was skipped because storage was down at
+	// startup. It runs once storage is reachable, until it succeeds.
+	Recovered func(ctx context.Context) error
+
+	mu      sync.Mutex
+	entries map[string]*spoolEntry
+	size    int64
+}
+
+// spoolEntry describes a spooled upload, stored as JSON next to its data
+type spoolEntry struct {
+	Name    string        `json:"name"`
+	Size    int64         `json:"size"`
+	Options UploadOptions `json:"options"`
+	Queued  time.Time     `json:"queued"`
+
+	path string
+}
+
+// NewSpooled wraps a backend with a circuit breaker and a spool in dir,
+// picking up files spooled before a restart
+func NewSpooled(backend Storage, dir string, cfg config.Config) (*Spooled, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool: %w", err)
+	}
+
+	s := &Spooled{
+		Storage: backend,
+		Breaker: NewBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		Dir:     dir,
+		MaxSize: cfg.SpoolMaxSize,
+		entries: map[string]*spoolEntry{},
+	}
+
+	// A MinIO probe also creates the bucket if it could not be created at startup
+	if minioClient, ok := Find[*MinioClient](backend); ok {
+		s.Probe = minioClient.EnsureBucket
+	} else {
+		s.Probe = func(ctx context.Context) error {
+			_, err := backend.ObjectExists(ctx, ".teleminio-probe")
+			return err
+		}
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if len(s.entries) > 0 {
+		fmt.Printf("Found %d spooled files waiting for upload\n", len(s.entries))
+	}
+	return s, nil
+}
+
+// Unwrap returns the guarded backend
+func (s *Spooled) Unwrap() Storage {
+	return s.Storage
+}
+
+// load reads the entries spooled before a restart
+func (s *Spooled) load() error {
+	matches, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read spool: %w", err)
+	}
+
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			return fmt.Errorf("failed to read spool: %w", err)
+		}
+		entry := &spoolEntry{path: strings.TrimSuffix(match, ".json")}
+		if err := json.Unmarshal(data, entry); err != nil {
+			fmt.Printf("Error reading spooled upload %s: %v\n", match, err)
+			continue
+		}
+		s.track(entry)
+	}
+	return nil
+}
+
+// track adds an entry to the spool, replacing an older upload of the same object
+func (s *Spooled) track(entry *spoolEntry) {
+	if old, ok := s.entries[entry.Name]; ok {
+		if old.Queued.After(entry.Queued) {
+			s.discard(entry)
+			return
+		}
+		s.discard(old)
+	}
+	s.entries[entry.Name] = entry
+	s.size += entry.Size
+}
+
+// discard removes the files of an entry; s.mu must be held
+func (s *Spooled) discard(entry *spoolEntry) {
+	os.Remove(entry.path + ".json")
+	os.Remove(entry.path + ".data")
+	if s.entries[entry.Name] == entry {
+		delete(s.entries, entry.Name)
+		s.size -= entry.Size
+	}
+}
+
+// writeEntry stores the description of an entry
+func writeEntry(entry *spoolEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := entry.path + ".json.tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, entry.path+".json")
+}
+
+// spool keeps an upload on local disk until storage is back
+func (s *Spooled) spool(objectName string, reader io.Reader, size int64, opts UploadOptions) error {
+	s.mu.Lock()
+	full := size > 0 && s.size+size > s.MaxSize
+	s.mu.Unlock()
+	if full {
+		return fmt.Errorf("%w, cannot keep %s", ErrSpoolFull, objectName)
+	}
+
+	f, err := os.CreateTemp(s.Dir, "*.data")
+	if err != nil {
+		return fmt.Errorf("failed to spool %s: %w", objectName, err)
+	}
+	written, err := io.Copy(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	entry := &spoolEntry{
+		Name:    objectName,
+		Size:    written,
+		Options: opts,
+		Queued:  time.Now(),
+		path:    strings.TrimSuffix(f.Name(), ".data"),
+	}
+	if err == nil {
+		err = writeEntry(entry)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to spool %s: %w", objectName, err)
+	}
+
+	s.mu.Lock()
+	s.track(entry)
+	s.mu.Unlock()
+
+	fmt.Printf("Storage is unavailable, spooled %s for later upload\n", objectName)
+	return nil
+}
+
+// spooled returns the spooled upload of an object
+func (s *Spooled) spooled(objectName string) (*spoolEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[objectName]
+	return entry, ok
+}
+
+// guard rejects calls while the breaker is open
+func (s *Spooled) guard() error {
+	if !s.Breaker.Allow() {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// record feeds the result of a call to the breaker
+func (s *Spooled) record(err error) error {
+	switch {
+	case err == nil:
+		s.Breaker.Success()
+	case IsUnavailable(err):
+		s.Breaker.Failure()
+	}
+	return err
+}
+
+// UploadFile uploads a file, or spools it when storage is unavailable.
+// A spooled file is reported as uploaded with an empty link.
+func (s *Spooled) UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error) {
+	if !s.Breaker.Allow() {
+		return "", s.spool(objectName, reader, size, opts)
+	}
+
+	// Keep the data around in case it has to be spooled after all
+	body, cleanup, err := replayable(reader)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	url, err := s.Storage.UploadFile(ctx, objectName, body, size, opts)
+	if s.record(err) == nil || !IsUnavailable(err) {
+		return url, err
+	}
+
+	if _, seekErr := body.Seek(start, io.SeekStart); seekErr != nil {
+		return "", err
+	}
+	if spoolErr := s.spool(objectName, body, size, opts); spoolErr != nil {
+		return "", errors.Join(err, spoolErr)
+	}
+	return "", nil
+}
+
+// GetFileURL generates a link to a file
+func (s *Spooled) GetFileURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	if err := s.guard(); err != nil {
+		return "", err
+	}
+	url, err := s.Storage.GetFileURL(ctx, objectName, expiry)
+	return url, s.record(err)
+}
+
+// DownloadFile downloads a file, reading spooled files from the spool
+func (s *Spooled) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	if entry, ok := s.spooled(objectName); ok {
+		return os.Open(entry.path + ".data")
+	}
+	if err := s.guard(); err != nil {
+		return nil, err
+	}
+	reader, err := s.Storage.DownloadFile(ctx, objectName)
+	return reader, s.record(err)
+}
+
+// ListFiles lists the stored files below a prefix
+func (s *Spooled) ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	if err := s.guard(); err != nil {
+		return nil, err
+	}
+	files, err := s.Storage.ListFiles(ctx, prefix)
+	return files, s.record(err)
+}
+
+// DeleteFile deletes a file, dropping it from the spool if it was not uploaded yet
+func (s *Spooled) DeleteFile(ctx context.Context, objectName string) error {
+	if entry, ok := s.spooled(objectName); ok {
+		s.mu.Lock()
+		s.discard(entry)
+		s.mu.Unlock()
+		if !s.Breaker.Allow() {
+			return nil
+		}
+	}
+	if err := s.guard(); err != nil {
+		return err
+	}
+	return s.record(s.Storage.DeleteFile(ctx, objectName))
+}
+
+// GetObjectInfo returns the attributes of a stored or spooled file
+func (s *Spooled) GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error) {
+	if entry, ok := s.spooled(objectName); ok {
+		header := http.Header{}
+		if entry.Options.ContentEncoding != "" {
+			header.Set("Content-Encoding", entry.Options.ContentEncoding)
+		}
+		return ObjectInfo{
+			Key:          entry.Name,
+			Size:         entry.Size,
+			ContentType:  entry.Options.ContentType,
+			LastModified: entry.Queued,
+			Metadata:     header,
+			UserMetadata: canonicalMetadata(entry.Options.Metadata),
+			UserTags:     entry.Options.Tags,
+		}, nil
+	}
+	if err := s.guard(); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.Storage.GetObjectInfo(ctx, objectName)
+	return info, s.record(err)
+}
+
+// ObjectExists reports whether a file is stored or spooled
+func (s *Spooled) ObjectExists(ctx context.Context, objectName string) (bool, error) {
+	if _, ok := s.spooled(objectName); ok {
+		return true, nil
+	}
+	if err := s.guard(); err != nil {
+		return false, err
+	}
+	exists, err := s.Storage.ObjectExists(ctx, objectName)
+	return exists, s.record(err)
+}
+
+// UpdateMetadata updates the metadata of a file. Spooled files get the
+// metadata when they are uploaded.
+func (s *Spooled) UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error {
+	if s.updateSpooled(objectName, func(opts *UploadOptions) {
+		if opts.Metadata == nil {
+			opts.Metadata = map[string]string{}
+		}
+		maps.Copy(opts.Metadata, metadata)
+	}) {
+		return nil
+	}
+	if err := s.guard(); err != nil {
+		return err
+	}
+	return s.record(s.Storage.UpdateMetadata(ctx, objectName, metadata))
+}
+
+// AddTags adds tags to a file. Spooled files get the tags when they are uploaded.
+func (s *Spooled) AddTags(ctx context.Context, objectName string, tags map[string]string) error {
+	if s.updateSpooled(objectName, func(opts *UploadOptions) {
+		if opts.Tags == nil {
+			opts.Tags = map[string]string{}
+		}
+		maps.Copy(opts.Tags, tags)
+	}) {
+		return nil
+	}
+	if err := s.guard(); err != nil {
+		return err
+	}
+	return s.record(s.Storage.AddTags(ctx, objectName, tags))
+}
+
+// updateSpooled changes the upload options of a spooled file and reports whether it was spooled
+func (s *Spooled) updateSpooled(objectName string, update func(opts *UploadOptions)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[objectName]
+	if !ok {
+		return false
+	}
+	update(&entry.Options)
+	if err := writeEntry(entry); err != nil {
+		fmt.Printf("Error updating spooled upload %s: %v\n", objectName, err)
+	}
+	return true
+}
+
+// MoveFile renames a file
+func (s *Spooled) MoveFile(ctx context.Context, objectName, newName string) error {
+	if err := s.guard(); err != nil {
+		return err
+	}
+	return s.record(s.Storage.MoveFile(ctx, objectName, newName))
+}
+
+// Run probes storage while the breaker is open and drains the spool once it
+// is closed, until the context is cancelled
+func (s *Spooled) Run(ctx context.Context) {
+	interval := min(s.Breaker.Cooldown, 10*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if s.Breaker.Ready() {
+			if err := s.Probe(ctx); err != nil {
+				fmt.Println("Storage is still unavailable:", err)
+				s.Breaker.Failure()
+			} else {
+				s.Breaker.Success()
+			}
+		}
+		if s.Breaker.Allow() {
+			if s.Recovered != nil {
+				if err := s.Recovered(ctx); err != nil {
+					fmt.Println("Error finishing setup after storage recovered:", err)
+				} else {
+					s.Recovered = nil
+				}
+			}
+			s.Drain(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Drain uploads the spooled files in the order they were spooled. It stops
+// when storage becomes unavailable again.
+func (s *Spooled) Drain(ctx context.Context) {
+	s.mu.Lock()
+	entries := make([]*spoolEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Queued.Before(entries[j].Queued) })
+
+	for _, entry := range entries {
+		if ctx.Err() != nil || !s.Breaker.Allow() {
+			return
+		}
+
+		err := s.upload(ctx, entry)
+		if s.record(err) != nil {
+			fmt.Printf("Error uploading spooled file %s: %v\n", entry.Name, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.discard(entry)
+		s.mu.Unlock()
+		fmt.Printf("Uploaded spooled file %s\n", entry.Name)
+	}
+}
+
+// upload sends a spooled file to storage
+func (s *Spooled) upload(ctx context.Context, entry *spoolEntry) error {
+	f, err := os.Open(entry.path + ".data")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.mu.Lock()
+	opts := entry.Options
+	opts.Metadata = maps.Clone(opts.Metadata)
+	opts.Tags = maps.Clone(opts.Tags)
+	s.mu.Unlock()
+
+	_, err = s.Storage.UploadFile(ctx, entry.Name, f, entry.Size, opts)
+	return err
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/config"
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo = minio.ObjectInfo
+
+// Storage is a backend archived files are stored in
+type Storage interface {
+	// UploadFile stores a file and returns a link to it
+	UploadFile(ctx context.Context, objectName string, reader io.Reader, size int64, opts UploadOptions) (string, error)
+	// GetFileURL returns a link to a file valid for the given duration
+	GetFileURL(ctx context.Context, objectName string, expiry time.Duration) (string, error)
+	// DownloadFile opens a stored file for reading
+	DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error)
+	// ListFiles lists all files with an optional prefix
+	ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// DeleteFile removes a file
+	DeleteFile(ctx context.Context, objectName string) error
+	// GetObjectInfo returns the attributes, metadata and tags of a file
+	GetObjectInfo(ctx context.Context, objectName string) (ObjectInfo, error)
+	// ObjectExists reports whether a file exists
+	ObjectExists(ctx context.Context, objectName string) (bool, error)
+	// UpdateMetadata merges metadata into a file's metadata
+	UpdateMetadata(ctx context.Context, objectName string, metadata map[string]string) error
+	// AddTags merges tags into a file's tags
+	AddTags(ctx context.Context, objectName string, tags map[string]string) error
+	// MoveFile renames a file
+	MoveFile(ctx context.Context, objectName, newName string) error
+}
+
+// Storage backends that can be configured
+const (
+	BackendMinio = "minio"
+	BackendLocal = "local"
+)
+
+// OpenBackend creates the storage backend selected in the configuration,
+// replicating to the configured storage targets and compressing and encrypting
+// files if enabled
+func OpenBackend(cfg config.Config) (Storage, error) {
+	// All MinIO clients share one memory budget for part buffers
+	multipart := NewMultipart(cfg)
+
+	var primary Storage
+	var err error
+	switch cfg.StorageBackend {
+	case BackendMinio, "":
+		primary, err = NewMinio(cfg, multipart)
+	case BackendLocal:
+		primary, err = NewLocalStorage(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backend := primary
+	if len(cfg.StorageTargets) > 0 {
+		backend, err = NewReplicated(primary, cfg, multipart)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Encrypt once so every target stores the same ciphertext
+	switch cfg.Encryption {
+	case config.EncryptionNone, "":
+	case config.EncryptionClient:
+		backend, err = NewEncrypted(backend, cfg)
+		if err != nil {
+			return nil, err
+		}
+	case config.EncryptionSSEC:
+		if cfg.StorageBackend == BackendLocal {
+			return nil, fmt.Errorf("SSE-C is only supported by the MinIO backend")
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q", cfg.Encryption)
+	}
+
+	// Compression has to happen before encryption
+	if cfg.Compression != "" && cfg.Compression != config.CompressionNone {
+		return NewCompressed(backend, cfg)
+	}
+
+	return backend, nil
+}
+
+// Find returns the first backend of type T in a chain of wrapped backends
+func Find[T Storage](s Storage) (T, bool) {
+	for s != nil {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+		wrapper, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = wrapper.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
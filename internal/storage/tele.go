@@ -12,6 +12,9 @@ import (
 	"go.etcd.io/bbolt"
 )
 
+// DefaultSessionDir is the directory holding session data and local databases
+const DefaultSessionDir = "session"
+
 // Setup initializes all storage components
 type Setup struct {
 	SessionDir     string
@@ -23,7 +26,7 @@ type Setup struct {
 // NewStorage sets up all storage components
 func NewStorage(phone string) (*Setup, error) {
 	// Setting up session storage directory
-	sessionDir := "session"
+	sessionDir := DefaultSessionDir
 	if err := os.MkdirAll(sessionDir, 0700); err != nil {
 		return nil, err
 	}
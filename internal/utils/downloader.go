@@ -8,12 +8,23 @@ import (
 
 	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/tg"
+	"github.com/rizkirmdhnnn/teleminio-uploader/internal/cache"
 )
 
+// PartSuffix marks files that are still being downloaded
+const PartSuffix = ".part"
+
 // MediaDownloader handles downloading of media files
 type MediaDownloader struct {
 	MediaDir string
 	API      *tg.Client
+
+	// Verify checks downloads against the hashes Telegram reports for the file
+	Verify bool
+
+	// Cache serves files that are still in the media directory without
+	// downloading them again. Downloaded files are pinned in the cache.
+	Cache *cache.MediaCache
 }
 
 // NewMediaDownloader creates a new media downloader
@@ -57,9 +68,7 @@ func (m *MediaDownloader) DownloadPhoto(ctx context.Context, photo *tg.Photo, us
 			FileReference: photo.FileReference,
 			ThumbSize:     largest.Type,
 		}
-		d := downloader.NewDownloader()
-		_, err := d.Download(m.API, loc).ToPath(ctx, fileName)
-		if err != nil {
+		if err := m.download(ctx, loc, fileName, int64(largest.Size)); err != nil {
 			return "", fmt.Errorf("failed to download photo: %w", err)
 		}
 		return fileName, nil
@@ -96,14 +105,41 @@ func (m *MediaDownloader) DownloadDocument(ctx context.Context, doc *tg.Document
 	}
 
 	loc := doc.AsInputDocumentFileLocation()
-	d := downloader.NewDownloader()
-	_, err := d.Download(m.API, loc).ToPath(ctx, fileName)
-	if err != nil {
+	if err := m.download(ctx, loc, fileName, doc.Size); err != nil {
 		return "", fmt.Errorf("failed to download document: %w", err)
 	}
 	return fileName, nil
 }
 
+// download writes a file to a .part file next to its destination and moves it
+// into place once it is complete, so leftovers of interrupted downloads are recognizable
+func (m *MediaDownloader) download(ctx context.Context, loc tg.InputFileLocationClass, fileName string, size int64) error {
+	if m.Cache != nil && size > 0 && m.Cache.Lookup(fileName, size) {
+		fmt.Printf("Using cached %s\n", filepath.Base(fileName))
+		return nil
+	}
+
+	partName := fileName + PartSuffix
+	defer os.Remove(partName)
+
+	d := downloader.NewDownloader()
+	if _, err := d.Download(m.API, loc).ToPath(ctx, partName); err != nil {
+		return err
+	}
+	if m.Verify {
+		if err := m.verifyFile(ctx, loc, partName, size); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(partName, fileName); err != nil {
+		return err
+	}
+	if m.Cache != nil {
+		m.Cache.Track(fileName)
+	}
+	return nil
+}
+
 // DownloadMedia downloads media from a message
 // return the path to the downloaded file, file extension and an error
 func (m *MediaDownloader) DownloadMedia(ctx context.Context, media tg.MessageMediaClass, username string) (string, string, error) {
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gotd/td/tg"
+)
+
+// rangeAttempts is how often a range that does not match its hash is downloaded again
+const rangeAttempts = 3
+
+// Precise file requests have to be aligned to 1 KiB and stay within a 1 MiB block
+const (
+	preciseAlign = 1024
+	preciseBlock = 1 << 20
+)
+
+// ErrHashMismatch is returned when a downloaded file does not match the hashes Telegram reports
+var ErrHashMismatch = errors.New("downloaded file does not match telegram hashes")
+
+// fileHashes fetches the SHA-256 hashes Telegram keeps for the ranges of a file
+func (m *MediaDownloader) fileHashes(ctx context.Context, loc tg.InputFileLocationClass, size int64) ([]tg.FileHash, error) {
+	var hashes []tg.FileHash
+	var offset int64
+	for offset < size {
+		batch, err := m.API.UploadGetFileHashes(ctx, &tg.UploadGetFileHashesRequest{
+			Location: loc,
+			Offset:   offset,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file hashes: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		hashes = append(hashes, batch...)
+		last := batch[len(batch)-1]
+		next := last.Offset + int64(last.Limit)
+		if next <= offset {
+			break
+		}
+		offset = next
+	}
+	return hashes, nil
+}
+
+// verifyFile checks a downloaded file against Telegram's hashes and downloads
+// the ranges that do not match again
+func (m *MediaDownloader) verifyFile(ctx context.Context, loc tg.InputFileLocationClass, path string, size int64) error {
+	hashes, err := m.fileHashes(ctx, loc, size)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		// Not every file has hashes, photos for example
+		fmt.Printf("Could not get Telegram's hashes for %s, skipping verification: %v\n", path, err)
+		return nil
+	}
+	if len(hashes) == 0 {
+		fmt.Printf("Telegram has no hashes for %s, skipping verification\n", path)
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to verify download: %w", err)
+	}
+	defer f.Close()
+
+	// Drop anything past the end Telegram reports
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to verify download: %w", err)
+	}
+
+	repaired := 0
+	for _, h := range hashes {
+		for attempt := 1; ; attempt++ {
+			ok, err := rangeMatches(f, h, size)
+			if err != nil {
+				return fmt.Errorf("failed to verify download: %w", err)
+			}
+			if ok {
+				break
+			}
+			if attempt > rangeAttempts {
+				return fmt.Errorf("%w: bytes %d-%d of %s", ErrHashMismatch, h.Offset, h.Offset+int64(h.Limit), path)
+			}
+
+			fmt.Printf("Bytes %d-%d of %s do not match Telegram's hash, downloading them again (%d/%d)\n", h.Offset, h.Offset+int64(h.Limit), path, attempt, rangeAttempts)
+			if err := m.refetchRange(ctx, loc, f, h, size); err != nil {
+				return err
+			}
+			repaired++
+		}
+	}
+
+	if repaired > 0 {
+		fmt.Printf("Repaired %d ranges of %s\n", repaired, path)
+	}
+	return nil
+}
+
+// rangeLength returns how many bytes of a file a hash covers
+func rangeLength(h tg.FileHash, size int64) int64 {
+	return min(int64(h.Limit), size-h.Offset)
+}
+
+// rangeMatches reports whether a range of the file matches its hash
+func rangeMatches(f *os.File, h tg.FileHash, size int64) (bool, error) {
+	n := rangeLength(h, size)
+	if n <= 0 {
+		return true, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, h.Offset, n)); err != nil {
+		return false, err
+	}
+	// A short file leaves the hash incomplete, which is a mismatch as well
+	return bytes.Equal(hash.Sum(nil), h.Hash), nil
+}
+
+// preciseRequest returns the offset and limit of a precise request covering
+// bytes from pos towards end: the offset is aligned down to 1 KiB, the limit
+// rounded up to 1 KiB and the request stops at the end of its 1 MiB block
+func preciseRequest(pos, end int64) (int64, int64) {
+	offset := pos - pos%preciseAlign
+	limit := end - offset
+	if rest := limit % preciseAlign; rest != 0 {
+		limit += preciseAlign - rest
+	}
+	return offset, min(limit, preciseBlock-offset%preciseBlock)
+}
+
+// refetchRange downloads a single range of a file and writes it in place.
+// Requests are widened to the alignment Telegram requires and trimmed to the range.
+func (m *MediaDownloader) refetchRange(ctx context.Context, loc tg.InputFileLocationClass, f *os.File, h tg.FileHash, size int64) error {
+	end := h.Offset + rangeLength(h, size)
+	for pos := h.Offset; pos < end; {
+		offset, limit := preciseRequest(pos, end)
+		result, err := m.API.UploadGetFile(ctx, &tg.UploadGetFileRequest{
+			Precise:  true,
+			Location: loc,
+			Offset:   offset,
+			Limit:    int(limit),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to download range: %w", err)
+		}
+		chunk, ok := result.(*tg.UploadFile)
+		if !ok {
+			return fmt.Errorf("failed to download range: unexpected response %T", result)
+		}
+
+		// Keep only the part of the response that is still missing
+		data := chunk.Bytes
+		if skip := pos - offset; int64(len(data)) > skip {
+			data = data[skip:]
+		} else {
+			data = nil
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%w: telegram returned no data at offset %d", ErrHashMismatch, pos)
+		}
+		data = data[:min(int64(len(data)), end-pos)]
+
+		if _, err := f.WriteAt(data, pos); err != nil {
+			return fmt.Errorf("failed to write range: %w", err)
+		}
+		pos += int64(len(data))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gotd/td/tg"
+)
+
+const kib = 1024
+
+func TestPreciseRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		pos, end    int64
+		offset, lim int64
+	}{
+		{"aligned range", 0, 128 * kib, 0, 128 * kib},
+		{"unaligned start", 1000, 128 * kib, 0, 128 * kib},
+		{"unaligned end", 128 * kib, 256*kib + 1, 128 * kib, 129 * kib},
+		{"single byte", 5000, 5001, 4 * kib, kib},
+		{"last range shorter than the hash range", 896 * kib, 896*kib + 300, 896 * kib, kib},
+		{"stops at the 1 MiB boundary", 960 * kib, 1088 * kib, 960 * kib, 64 * kib},
+		{"unaligned start near the boundary", preciseBlock - 10, preciseBlock + 10, preciseBlock - kib, kib},
+		{"starts on the boundary", preciseBlock, preciseBlock + 128*kib, preciseBlock, 128 * kib},
+		{"whole block", 3 * preciseBlock, 5 * preciseBlock, 3 * preciseBlock, preciseBlock},
+	}
+	for _, tt := range tests {
+		offset, limit := preciseRequest(tt.pos, tt.end)
+		if offset != tt.offset || limit != tt.lim {
+			t.Errorf("%s: preciseRequest(%d, %d) = %d, %d, want %d, %d", tt.name, tt.pos, tt.end, offset, limit, tt.offset, tt.lim)
+		}
+
+		// The rules Telegram enforces for precise requests
+		if offset%preciseAlign != 0 || limit%preciseAlign != 0 || limit <= 0 {
+			t.Errorf("%s: request %d+%d is not aligned to 1 KiB", tt.name, offset, limit)
+		}
+		if offset/preciseBlock != (offset+limit-1)/preciseBlock {
+			t.Errorf("%s: request %d+%d crosses a 1 MiB boundary", tt.name, offset, limit)
+		}
+		if offset > tt.pos || offset+limit <= tt.pos {
+			t.Errorf("%s: request %d+%d does not cover position %d", tt.name, offset, limit, tt.pos)
+		}
+	}
+}
+
+func TestRangeMatches(t *testing.T) {
+	data := make([]byte, 300*kib)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	size := int64(len(data))
+	hashOf := func(offset, limit int64) tg.FileHash {
+		end := min(offset+limit, size)
+		sum := sha256.Sum256(data[offset:end])
+		return tg.FileHash{Offset: offset, Limit: int(limit), Hash: sum[:]}
+	}
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The last range is shorter than its limit
+	for _, h := range []tg.FileHash{hashOf(0, 128*kib), hashOf(128*kib, 128*kib), hashOf(256*kib, 128*kib)} {
+		ok, err := rangeMatches(f, h, size)
+		if err != nil || !ok {
+			t.Errorf("range at %d does not match: %v", h.Offset, err)
+		}
+	}
+
+	// A range past the end of the file has nothing to check
+	if ok, _ := rangeMatches(f, tg.FileHash{Offset: size, Limit: 128 * kib}, size); !ok {
+		t.Error("range past the end does not match")
+	}
+
+	// A download that stopped early does not match
+	if err := os.WriteFile(path, data[:200*kib], 0644); err != nil {
+		t.Fatal(err)
+	}
+	short, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer short.Close()
+	for _, h := range []tg.FileHash{hashOf(128*kib, 128*kib), hashOf(256*kib, 128*kib)} {
+		ok, err := rangeMatches(short, h, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("range at %d of a truncated file matches", h.Offset)
+		}
+	}
+	if ok, _ := rangeMatches(short, hashOf(0, 128*kib), size); !ok {
+		t.Error("complete range of a truncated file does not match")
+	}
+
+	// Changed bytes do not match
+	corrupt := append([]byte{}, data...)
+	corrupt[130*kib] ^= 0xff
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changed.Close()
+	if ok, _ := rangeMatches(changed, hashOf(128*kib, 128*kib), size); ok {
+		t.Error("range with a changed byte matches")
+	}
+}